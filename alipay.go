@@ -1,12 +1,19 @@
 package pay4go
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"github.com/smartwalle/alipay"
 	"github.com/smartwalle/ngx"
 	"net/http"
+	"net/url"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -15,6 +22,8 @@ const (
 
 type AliPay struct {
 	client    *alipay.AliPay
+	mu        sync.Mutex
+	store     Store
 	ReturnURL string // 支付成功之后回调 URL
 	CancelURL string // 用户取消付款回调 URL
 	NotifyURL string
@@ -26,40 +35,81 @@ func NewAliPay(appId, aliPublicKey, privateKey string, isProduction bool) *AliPa
 	return p
 }
 
+// SetStore 设置用于查询订单全部退款的 Store，支付宝的退款查询接口必须提供退款请求号，需要使用 Store 中保存的退款编号查询，
+// 通过 Service.RegisterChannel 注册或者调用 Service.SetStore 时会自动设置为 Service 的 Store
+func (this *AliPay) SetStore(store Store) {
+	this.mu.Lock()
+	this.store = store
+	this.mu.Unlock()
+}
+
 func (this *AliPay) Identifier() string {
 	return K_CHANNEL_ALIPAY
 }
 
-func (this *AliPay) CreateTradeOrder(order *Order) (url string, err error) {
-	var productAmount float64 = 0
-	var productTax float64 = 0
-	for _, p := range order.ProductList {
-		productAmount += p.Price * float64(p.Quantity)
-		productTax += p.Tax * float64(p.Quantity)
-	}
+const (
+	k_ALIPAY_CODE_WAIT_BUYER_PAY      = "10003" // 等待用户付款（当面付）
+	k_ALIPAY_CODE_UNKNOWN             = "20000" // 支付结果未知（当面付）
+	k_ALIPAY_SUB_CODE_TRADE_NOT_EXIST = "ACQ.TRADE_NOT_EXIST"
+
+	k_ALIPAY_TIME_LAYOUT = "2006-01-02 15:04:05"
+
+	k_ALIPAY_CANCEL_RETRY = 3
+)
+
+func (this *AliPay) Capability() *Capability {
+	var c = &Capability{}
+	c.DefaultTradeMethod = K_TRADE_METHOD_WEB
+	c.TradeMethods = []string{K_TRADE_METHOD_WEB, K_TRADE_METHOD_WAP, K_TRADE_METHOD_APP, K_TRADE_METHOD_QRCODE, K_TRADE_METHOD_F2F}
+	c.Currencies = []string{K_CURRENCY_CNY}
+	c.Features = []string{K_FEATURE_QUERY_BY_ORDER_NO, K_FEATURE_REFUND, K_FEATURE_REFUND_QUERY, K_FEATURE_REFUND_LIST, K_FEATURE_CLOSE_TRADE, K_FEATURE_DOWNLOAD_BILL}
+	return c
+}
+
+func (this *AliPay) CreateTradeOrder(order *Order) (result *PaymentIntent, err error) {
+	return this.CreateTradeOrderContext(context.Background(), order)
+}
+
+func (this *AliPay) CreateTradeOrderContext(ctx context.Context, order *Order) (result *PaymentIntent, err error) {
 	var subject = strings.TrimSpace(order.Subject)
 	if subject == "" {
 		subject = order.OrderNo
 	}
 
-	var amount = fmt.Sprintf("%.2f", productAmount+productTax+order.Shipping-order.Discount)
+	var amount = order.TotalAmount().String()
+
+	result = &PaymentIntent{}
+	result.Channel = this.Identifier()
+	result.OrderNo = order.OrderNo
+	result.ExpiresAt = expiresAt(order.Timeout)
 
 	switch order.TradeMethod {
 	case K_TRADE_METHOD_WAP:
-		return this.tradeWapPay(order.OrderNo, subject, amount, order.Timeout)
+		result.Kind = K_PAYMENT_KIND_REDIRECT
+		result.Payload, err = this.tradeWapPay(ctx, order.OrderNo, subject, amount, order.Timeout)
 	case K_TRADE_METHOD_APP:
-		return this.tradeAppPay(order.OrderNo, subject, amount, order.Timeout)
+		result.Kind = K_PAYMENT_KIND_APP_PARAMS
+		result.Payload, err = this.tradeAppPay(ctx, order.OrderNo, subject, amount, order.Timeout)
 	case K_TRADE_METHOD_QRCODE:
-		return this.tradeQRCode(order.OrderNo, subject, amount, order.Timeout)
+		result.Kind = K_PAYMENT_KIND_QRCODE
+		result.Payload, err = this.tradeQRCode(ctx, order.OrderNo, subject, amount, order.Timeout)
 	case K_TRADE_METHOD_F2F:
-		return this.tradeFaceToFace(order.OrderNo, order.AuthCode, subject, amount, order.Timeout)
+		result.Kind = K_PAYMENT_KIND_COMPLETED
+		result.ExpiresAt = time.Time{}
+		result.TradeNo, err = this.tradeFaceToFace(ctx, order.OrderNo, order.AuthCode, subject, amount, order.Timeout)
+	case K_TRADE_METHOD_WEB, "":
+		result.Kind = K_PAYMENT_KIND_REDIRECT
+		result.Payload, err = this.tradeWebPay(ctx, order.OrderNo, subject, amount, order.Timeout)
 	default:
-		return this.tradeWebPay(order.OrderNo, subject, amount, order.Timeout)
+		return nil, &CapabilityError{Channel: this.Identifier(), Kind: K_CAPABILITY_TRADE_METHOD, Value: order.TradeMethod}
 	}
-	return "", err
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-func (this *AliPay) tradeWebPay(orderNo, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeWebPay(ctx context.Context, orderNo, subject, amount string, timeout int) (payload string, err error) {
 	var p = alipay.AliPayTradePagePay{}
 	p.OutTradeNo = orderNo
 
@@ -81,14 +131,18 @@ func (this *AliPay) tradeWebPay(orderNo, subject, amount string, timeout int) (u
 		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
 	}
 
-	rawURL, err := this.client.TradePagePay(p)
+	var rawURL *url.URL
+	err = invoke(ctx, func() (err error) {
+		rawURL, err = this.client.TradePagePay(p)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 	return rawURL.String(), err
 }
 
-func (this *AliPay) tradeWapPay(orderNo, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeWapPay(ctx context.Context, orderNo, subject, amount string, timeout int) (payload string, err error) {
 	var p = alipay.AliPayTradeWapPay{}
 	p.OutTradeNo = orderNo
 
@@ -114,14 +168,18 @@ func (this *AliPay) tradeWapPay(orderNo, subject, amount string, timeout int) (u
 		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
 	}
 
-	rawURL, err := this.client.TradeWapPay(p)
+	var rawURL *url.URL
+	err = invoke(ctx, func() (err error) {
+		rawURL, err = this.client.TradeWapPay(p)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 	return rawURL.String(), err
 }
 
-func (this *AliPay) tradeAppPay(orderNo, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeAppPay(ctx context.Context, orderNo, subject, amount string, timeout int) (payload string, err error) {
 	var p = alipay.AliPayTradeAppPay{}
 	p.OutTradeNo = orderNo
 
@@ -136,10 +194,14 @@ func (this *AliPay) tradeAppPay(orderNo, subject, amount string, timeout int) (u
 	if timeout > 0 {
 		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
 	}
-	return this.client.TradeAppPay(p)
+	err = invoke(ctx, func() (err error) {
+		payload, err = this.client.TradeAppPay(p)
+		return err
+	})
+	return payload, err
 }
 
-func (this *AliPay) tradeQRCode(orderNo, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeQRCode(ctx context.Context, orderNo, subject, amount string, timeout int) (payload string, err error) {
 	var p = alipay.AliPayTradePreCreate{}
 	p.OutTradeNo = orderNo
 
@@ -154,7 +216,11 @@ func (this *AliPay) tradeQRCode(orderNo, subject, amount string, timeout int) (u
 		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
 	}
 
-	rsp, err := this.client.TradePreCreate(p)
+	var rsp *alipay.AliPayPreCreateResponse
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.TradePreCreate(p)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
@@ -164,7 +230,7 @@ func (this *AliPay) tradeQRCode(orderNo, subject, amount string, timeout int) (u
 	return rsp.AliPayPreCreateResponse.QRCode, err
 }
 
-func (this *AliPay) tradeFaceToFace(orderNo, authCode, subject, amount string, timeout int) (url string, err error) {
+func (this *AliPay) tradeFaceToFace(ctx context.Context, orderNo, authCode, subject, amount string, timeout int) (tradeNo string, err error) {
 	var p = alipay.AliPayTradePay{}
 	p.OutTradeNo = orderNo
 
@@ -181,18 +247,81 @@ func (this *AliPay) tradeFaceToFace(orderNo, authCode, subject, amount string, t
 		p.TimeoutExpress = fmt.Sprintf("%dm", timeout)
 	}
 
-	result, err := this.client.TradePay(p)
-	if err != nil {
+	var rsp *alipay.AliPayTradePayResponse
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.TradePay(p)
+		return err
+	})
+	if err == nil {
+		switch rsp.AliPayTradePay.Code {
+		case alipay.K_SUCCESS_CODE:
+			return rsp.AliPayTradePay.TradeNo, nil
+		case k_ALIPAY_CODE_WAIT_BUYER_PAY, k_ALIPAY_CODE_UNKNOWN:
+			// 需要等待用户输入密码或者支付结果未知，需要查询订单确认
+		default:
+			// 明确失败的交易不需要撤销
+			return "", errors.New(rsp.AliPayTradePay.SubMsg)
+		}
+	}
+
+	if tradeNo, err = this.waitForPayment(ctx, orderNo); err != nil {
+		// ctx 被取消时也需要撤销交易，避免之后用户完成支付
+		if cErr := this.cancelTrade(context.Background(), orderNo); cErr != nil {
+			var e = &TradeReverseError{}
+			e.Channel = K_CHANNEL_ALIPAY
+			e.OrderNo = orderNo
+			e.Err = err
+			e.ReverseErr = cErr
+			return "", e
+		}
 		return "", err
 	}
-	return result.AliPayTradePay.TradeNo, err
+	return tradeNo, nil
+}
+
+// waitForPayment 轮询订单状态，直到支付成功、交易关闭或者超时
+func (this *AliPay) waitForPayment(ctx context.Context, orderNo string) (tradeNo string, err error) {
+	var p = alipay.AliPayTradeQuery{}
+	p.OutTradeNo = orderNo
+
+	var deadline = time.Now().Add(k_F2F_QUERY_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if err = sleep(ctx, k_F2F_QUERY_INTERVAL); err != nil {
+			return "", err
+		}
+
+		var rsp *alipay.AliPayTradeQueryResponse
+		err = call(ctx, func() (err error) {
+			rsp, err = this.client.TradeQuery(p)
+			return err
+		})
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err != nil || rsp.AliPayTradeQuery.Code != alipay.K_SUCCESS_CODE {
+			continue
+		}
+
+		switch rsp.AliPayTradeQuery.TradeStatus {
+		case alipay.K_TRADE_STATUS_TRADE_SUCCESS, alipay.K_TRADE_STATUS_TRADE_FINISHED:
+			return rsp.AliPayTradeQuery.TradeNo, nil
+		case alipay.K_TRADE_STATUS_TRADE_CLOSED:
+			return "", ErrTradeClosed
+		}
+	}
+	return "", ErrTradeTimeout
 }
 
-func (this *AliPay) getTrade(tradeNo, orderNo string) (result *Trade, err error) {
+func (this *AliPay) getTrade(ctx context.Context, tradeNo, orderNo string) (result *Trade, err error) {
 	var p = alipay.AliPayTradeQuery{}
 	p.TradeNo = tradeNo
 	p.OutTradeNo = orderNo
-	rsp, err := this.client.TradeQuery(p)
+
+	var rsp *alipay.AliPayTradeQueryResponse
+	err = call(ctx, func() (err error) {
+		rsp, err = this.client.TradeQuery(p)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -207,21 +336,340 @@ func (this *AliPay) getTrade(tradeNo, orderNo string) (result *Trade, err error)
 	result.OrderNo = rsp.AliPayTradeQuery.OutTradeNo
 	result.TradeNo = rsp.AliPayTradeQuery.TradeNo
 	result.TradeStatus = rsp.AliPayTradeQuery.TradeStatus
-	result.TotalAmount = rsp.AliPayTradeQuery.TotalAmount
+	result.Status = tradeStatusWithAliPay(result.TradeStatus)
+	if result.TotalAmount, err = ParseMoney(rsp.AliPayTradeQuery.TotalAmount, K_CURRENCY_CNY); err != nil {
+		return nil, err
+	}
 	result.PayerId = rsp.AliPayTradeQuery.BuyerUserId
 	result.PayerEmail = rsp.AliPayTradeQuery.BuyerLogonId
+	result.PaidAt = parseTime(k_ALIPAY_TIME_LAYOUT, rsp.AliPayTradeQuery.SendPayDate, k_CHINA_LOCATION)
 	if result.TradeStatus == alipay.K_TRADE_STATUS_TRADE_SUCCESS || result.TradeStatus == alipay.K_TRADE_STATUS_TRADE_FINISHED {
 		result.TradeSuccess = true
 	}
+
+	// 交易查询接口不返回已退款金额，只能识别出已支付的交易全额退款之后被关闭的情况
+	if result.TradeStatus == alipay.K_TRADE_STATUS_TRADE_CLOSED && !result.PaidAt.IsZero() {
+		result.Status = K_TRADE_STATUS_REFUNDED
+		result.RefundedAmount = result.TotalAmount
+	}
+	result.settle()
 	return result, nil
 }
 
+func tradeStatusWithAliPay(status string) string {
+	switch status {
+	case alipay.K_TRADE_STATUS_TRADE_SUCCESS, alipay.K_TRADE_STATUS_TRADE_FINISHED:
+		return K_TRADE_STATUS_PAID
+	case alipay.K_TRADE_STATUS_TRADE_CLOSED:
+		// 支付宝全额退款之后交易状态也为 TRADE_CLOSED
+		return K_TRADE_STATUS_CLOSED
+	}
+	return K_TRADE_STATUS_PENDING
+}
+
 func (this *AliPay) GetTrade(tradeNo string) (result *Trade, err error) {
-	return this.getTrade(tradeNo, "")
+	return this.GetTradeContext(context.Background(), tradeNo)
+}
+
+func (this *AliPay) GetTradeContext(ctx context.Context, tradeNo string) (result *Trade, err error) {
+	return this.getTrade(ctx, tradeNo, "")
 }
 
 func (this *AliPay) GetTradeWithOrderNo(orderNo string) (result *Trade, err error) {
-	return this.getTrade("", orderNo)
+	return this.GetTradeWithOrderNoContext(context.Background(), orderNo)
+}
+
+func (this *AliPay) GetTradeWithOrderNoContext(ctx context.Context, orderNo string) (result *Trade, err error) {
+	return this.getTrade(ctx, "", orderNo)
+}
+
+func (this *AliPay) Refund(req *RefundRequest) (result *Refund, err error) {
+	return this.RefundContext(context.Background(), req)
+}
+
+func (this *AliPay) RefundContext(ctx context.Context, req *RefundRequest) (result *Refund, err error) {
+	var amount = req.Amount
+	if amount.Amount <= 0 {
+		// 全额退款
+		trade, err := this.getTrade(ctx, req.TradeNo, req.OrderNo)
+		if err != nil {
+			return nil, err
+		}
+		amount = trade.TotalAmount
+	}
+
+	var p = alipay.AliPayTradeRefund{}
+	p.OutTradeNo = req.OrderNo
+	p.TradeNo = req.TradeNo
+	p.OutRequestNo = req.RefundNo
+	p.RefundAmount = amount.String()
+	p.RefundReason = req.Reason
+
+	var rsp *alipay.AliPayTradeRefundResponse
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.TradeRefund(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.AliPayTradeRefund.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(rsp.AliPayTradeRefund.SubMsg)
+	}
+
+	result = &Refund{}
+	result.Channel = this.Identifier()
+	result.RawRefund = rsp
+	result.OrderNo = rsp.AliPayTradeRefund.OutTradeNo
+	result.TradeNo = rsp.AliPayTradeRefund.TradeNo
+	result.RefundNo = req.RefundNo
+	result.RefundAmount = amount
+	// 支付宝退款为同步处理，接口返回成功即表示退款成功
+	result.RefundStatus = K_REFUND_STATUS_SUCCESS
+	return result, nil
+}
+
+func (this *AliPay) GetRefund(orderNo, refundNo string) (result *Refund, err error) {
+	return this.GetRefundContext(context.Background(), orderNo, refundNo)
+}
+
+func (this *AliPay) GetRefundContext(ctx context.Context, orderNo, refundNo string) (result *Refund, err error) {
+	var p = alipay.AliPayFastpayTradeRefundQuery{}
+	p.OutTradeNo = orderNo
+	p.OutRequestNo = refundNo
+
+	var rsp *alipay.AliPayFastpayTradeRefundQueryResponse
+	err = call(ctx, func() (err error) {
+		rsp, err = this.client.TradeFastpayRefundQuery(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var refund = rsp.AliPayTradeFastpayRefundQueryResponse
+	if refund.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(refund.SubMsg)
+	}
+	// 没有查询到退款信息表示该笔退款未成功
+	if refund.RefundAmount == "" {
+		return nil, ErrUnknownRefundNo
+	}
+	refundAmount, err := ParseMoney(refund.RefundAmount, K_CURRENCY_CNY)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Refund{}
+	result.Channel = this.Identifier()
+	result.RawRefund = rsp
+	result.OrderNo = refund.OutTradeNo
+	result.TradeNo = refund.TradeNo
+	result.RefundNo = refund.OutRequestNo
+	result.RefundAmount = refundAmount
+	result.RefundStatus = K_REFUND_STATUS_SUCCESS
+	return result, nil
+}
+
+// GetRefundsForOrder 查询订单的所有退款，支付宝需要通过 Store 中保存的退款编号逐个查询，只能查询到通过 Service 发起的退款
+func (this *AliPay) GetRefundsForOrder(orderNo string) (result []*Refund, err error) {
+	return this.GetRefundsForOrderContext(context.Background(), orderNo)
+}
+
+func (this *AliPay) GetRefundsForOrderContext(ctx context.Context, orderNo string) (result []*Refund, err error) {
+	this.mu.Lock()
+	var store = this.store
+	this.mu.Unlock()
+	if store == nil {
+		return nil, ErrStoreNotSet
+	}
+
+	refundKeys, err := store.FindRefunds(ctx, this.Identifier(), orderNo)
+	if err != nil {
+		return nil, err
+	}
+
+	result = make([]*Refund, 0, len(refundKeys))
+	for _, refundNo := range refundKeys {
+		// 退款时没有提供退款请求号的，支付宝使用订单号作为退款请求号
+		if refundNo == "" {
+			refundNo = orderNo
+		}
+		refund, err := this.GetRefundContext(ctx, orderNo, refundNo)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, refund)
+	}
+	return result, nil
+}
+
+func (this *AliPay) CloseTrade(orderNo string) (err error) {
+	return this.CloseTradeContext(context.Background(), orderNo)
+}
+
+func (this *AliPay) CloseTradeContext(ctx context.Context, orderNo string) (err error) {
+	var p = alipay.AliPayTradeClose{}
+	p.OutTradeNo = orderNo
+
+	var rsp *alipay.AliPayTradeCloseResponse
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.TradeClose(p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if rsp.AliPayTradeClose.Code == alipay.K_SUCCESS_CODE {
+		return nil
+	}
+
+	// 用户还没有扫码或者输入密码（当面付），支付宝端还没有创建交易，这时候需要撤销交易
+	if rsp.AliPayTradeClose.SubCode == k_ALIPAY_SUB_CODE_TRADE_NOT_EXIST {
+		return this.cancelTrade(ctx, orderNo)
+	}
+	return errors.New(rsp.AliPayTradeClose.SubMsg)
+}
+
+// cancelTrade 撤销交易，支付宝返回需要重试时会进行重试
+func (this *AliPay) cancelTrade(ctx context.Context, orderNo string) (err error) {
+	var p = alipay.AliPayTradeCancel{}
+	p.OutTradeNo = orderNo
+
+	for i := 0; i < k_ALIPAY_CANCEL_RETRY; i++ {
+		var rsp *alipay.AliPayTradeCancelResponse
+		err = invoke(ctx, func() (err error) {
+			rsp, err = this.client.TradeCancel(p)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if rsp.AliPayTradeCancel.Code == alipay.K_SUCCESS_CODE {
+			return nil
+		}
+		if rsp.AliPayTradeCancel.RetryFlag != "Y" {
+			return errors.New(rsp.AliPayTradeCancel.SubMsg)
+		}
+	}
+	return ErrTradeReverseFailed
+}
+
+const (
+	k_ALIPAY_BILL_TYPE_TRADE  = "trade"
+	k_ALIPAY_BILL_DATE_LAYOUT = "2006-01-02"
+
+	// 业务明细对账单中各个字段的位置
+	k_ALIPAY_BILL_COLUMN_TRADE_NO    = 0
+	k_ALIPAY_BILL_COLUMN_ORDER_NO    = 1
+	k_ALIPAY_BILL_COLUMN_FINISHED_AT = 5
+	k_ALIPAY_BILL_COLUMN_AMOUNT      = 11
+	k_ALIPAY_BILL_COLUMN_REFUND_NO   = 21
+	k_ALIPAY_BILL_COLUMN_FEE         = 22
+)
+
+func (this *AliPay) DownloadBill(date time.Time) (result *Bill, err error) {
+	return this.DownloadBillContext(context.Background(), date)
+}
+
+// DownloadBillContext 下载业务明细对账单，对账单为包含 CSV 文件的 zip 压缩包，CSV 文件使用 GBK 编码，
+// 只解析需要的字段，不对中文字段进行转码
+func (this *AliPay) DownloadBillContext(ctx context.Context, date time.Time) (result *Bill, err error) {
+	result = &Bill{}
+	result.Channel = this.Identifier()
+	result.Start, result.End = billDay(date, k_CHINA_LOCATION)
+
+	var p = alipay.BillDownloadURLQuery{}
+	p.BillType = k_ALIPAY_BILL_TYPE_TRADE
+	p.BillDate = result.Start.Format(k_ALIPAY_BILL_DATE_LAYOUT)
+
+	var rsp *alipay.BillDownloadURLQueryResponse
+	err = call(ctx, func() (err error) {
+		rsp, err = this.client.BillDownloadURLQuery(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rsp.AliPayDataServiceBillDownloadURLQueryResponse.Code != alipay.K_SUCCESS_CODE {
+		return nil, errors.New(rsp.AliPayDataServiceBillDownloadURLQueryResponse.SubMsg)
+	}
+
+	data, err := downloadBill(ctx, rsp.AliPayDataServiceBillDownloadURLQueryResponse.BillDownloadUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range zr.File {
+		if !strings.HasSuffix(strings.ToLower(file.Name), ".csv") {
+			continue
+		}
+		records, err := this.parseBill(file)
+		if err != nil {
+			return nil, err
+		}
+		result.Records = append(result.Records, records...)
+	}
+	return result, nil
+}
+
+// parseBill 压缩包中还包含业务明细汇总文件，其字段数量较少，会被忽略
+func (this *AliPay) parseBill(file *zip.File) (result []*BillRecord, err error) {
+	rc, err := file.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var r = csv.NewReader(rc)
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		if len(row) <= k_ALIPAY_BILL_COLUMN_FEE {
+			continue
+		}
+		for i := range row {
+			row[i] = strings.TrimSpace(row[i])
+		}
+
+		// 标题行及以 # 开头的说明行的金额字段无法解析
+		amount, err := parseBillMoney(row[k_ALIPAY_BILL_COLUMN_AMOUNT], K_CURRENCY_CNY)
+		if err != nil || row[k_ALIPAY_BILL_COLUMN_TRADE_NO] == "" {
+			continue
+		}
+		fee, err := parseBillMoney(row[k_ALIPAY_BILL_COLUMN_FEE], K_CURRENCY_CNY)
+		if err != nil {
+			return nil, err
+		}
+
+		var record = &BillRecord{}
+		record.Channel = this.Identifier()
+		record.Type = K_BILL_TYPE_TRADE
+		record.TradeNo = row[k_ALIPAY_BILL_COLUMN_TRADE_NO]
+		record.OrderNo = row[k_ALIPAY_BILL_COLUMN_ORDER_NO]
+		record.Amount = amount
+		record.Fee = fee
+		record.Time = parseTime(k_ALIPAY_TIME_LAYOUT, row[k_ALIPAY_BILL_COLUMN_FINISHED_AT], k_CHINA_LOCATION)
+		record.RawRecord = row
+		// 业务类型为中文（GBK 编码），通过退款批次号区分退款记录
+		if refundNo := row[k_ALIPAY_BILL_COLUMN_REFUND_NO]; refundNo != "" {
+			record.Type = K_BILL_TYPE_REFUND
+			record.RefundNo = refundNo
+		}
+		result = append(result, record)
+	}
+	return result, nil
 }
 
 func (this *AliPay) ReturnRequestHandler(req *http.Request) (result *Trade, err error) {
@@ -229,7 +677,7 @@ func (this *AliPay) ReturnRequestHandler(req *http.Request) (result *Trade, err
 	if tradeNo == "" {
 		return nil, ErrUnknownTradeNo
 	}
-	trade, err := this.GetTrade(tradeNo)
+	trade, err := this.GetTradeContext(req.Context(), tradeNo)
 	if err != nil {
 		return nil, err
 	}
@@ -248,15 +696,46 @@ func (this *AliPay) NotifyRequestHandler(req *http.Request) (result *Notificatio
 
 	result = &Notification{}
 	result.Channel = this.Identifier()
+	result.NotifyId = noti.NotifyId
 	result.RawNotify = noti
 
-	// TODO 需要处理退款
 	switch noti.NotifyType {
 	case alipay.K_NOTIFY_TYPE_TRADE_STATUS_SYNC:
 		result.NotifyType = K_NOTIFY_TYPE_TRADE
 		result.OrderNo = noti.OutTradeNo
 		result.TradeNo = noti.TradeNo
+		result.TradeStatus = noti.TradeStatus
+		result.Status = tradeStatusWithAliPay(noti.TradeStatus)
+		result.PayerId = noti.BuyerId
+		result.PayerEmail = noti.BuyerLogonId
+		if result.Amount, err = ParseMoney(noti.TotalAmount, K_CURRENCY_CNY); err != nil {
+			return nil, err
+		}
+
+		// 退款通知和交易通知的类型一样，通过退款请求号和退款金额进行区分
+		if noti.OutBizNo != "" && noti.RefundFee != "" {
+			result.NotifyType = K_NOTIFY_TYPE_REFUND
+			result.RefundNo = noti.OutBizNo
+			// 支付宝只有在退款成功之后才会发送通知，全额退款之后交易状态为 TRADE_CLOSED
+			result.RefundStatus = K_REFUND_STATUS_SUCCESS
+			result.Status = K_TRADE_STATUS_PARTIALLY_REFUNDED
+			if noti.TradeStatus == alipay.K_TRADE_STATUS_TRADE_CLOSED {
+				result.Status = K_TRADE_STATUS_REFUNDED
+			}
+			if result.RefundAmount, err = ParseMoney(noti.RefundFee, K_CURRENCY_CNY); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return result, err
 }
+
+// WriteNotifyResponse 支付宝需要返回 success，否则会重新发送通知
+func (this *AliPay) WriteNotifyResponse(w http.ResponseWriter, err error) {
+	if err != nil {
+		w.Write([]byte("fail"))
+		return
+	}
+	w.Write([]byte("success"))
+}
@@ -0,0 +1,44 @@
+package pay4go
+
+import "context"
+
+// AmountLookup 查询创建订单时的订单金额，用于校验通知及同步返回中的金额是否被篡改
+type AmountLookup interface {
+	// LookupAmount 查询订单金额，订单不存在时 ok 返回 false，此时不进行校验
+	LookupAmount(ctx context.Context, channel, orderNo string) (amount Money, ok bool, err error)
+}
+
+// AmountLookupFunc 将普通函数转换为 AmountLookup
+type AmountLookupFunc func(ctx context.Context, channel, orderNo string) (amount Money, ok bool, err error)
+
+func (this AmountLookupFunc) LookupAmount(ctx context.Context, channel, orderNo string) (Money, bool, error) {
+	return this(ctx, channel, orderNo)
+}
+
+// SetAmountLookup 设置订单金额的查询方式，设置之后通知及同步返回中的金额与订单金额不一致时返回 ErrAmountMismatch，
+// 为 nil 时不进行校验
+func (this *Service) SetAmountLookup(lookup AmountLookup) {
+	this.mu.Lock()
+	this.lookup = lookup
+	this.mu.Unlock()
+}
+
+// verifyAmount 校验支付渠道返回的金额，amount 的货币为空表示支付渠道没有返回金额（例如 PayPal 的退款及争议通知），不进行校验
+func (this *Service) verifyAmount(ctx context.Context, channel, orderNo string, amount Money) error {
+	this.mu.RLock()
+	var lookup = this.lookup
+	this.mu.RUnlock()
+
+	if lookup == nil || orderNo == "" || amount.Currency == "" {
+		return nil
+	}
+
+	expected, ok, err := lookup.LookupAmount(ctx, channel, orderNo)
+	if err != nil {
+		return err
+	}
+	if ok && !expected.Equal(amount) {
+		return ErrAmountMismatch
+	}
+	return nil
+}
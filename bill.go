@@ -0,0 +1,195 @@
+package pay4go
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	K_BILL_TYPE_TRADE  = "trade"  // 支付
+	K_BILL_TYPE_REFUND = "refund" // 退款
+)
+
+// Bill 支付渠道某一天的对账单
+type Bill struct {
+	Channel string        `json:"channel"`
+	Start   time.Time     `json:"start"` // 对账单的开始时间（包含），为支付渠道所在时区的零点
+	End     time.Time     `json:"end"`   // 对账单的结束时间（不包含）
+	Records []*BillRecord `json:"records"`
+}
+
+// BillRecord 对账单中的一条交易或者退款记录
+type BillRecord struct {
+	Channel  string    `json:"channel"`
+	Type     string    `json:"type"` // K_BILL_TYPE_TRADE 或者 K_BILL_TYPE_REFUND
+	OrderNo  string    `json:"order_no"`
+	TradeNo  string    `json:"trade_no"`
+	RefundNo string    `json:"refund_no"` // 退款编号，支付宝为退款请求号，微信支付为商户退款单号，PayPal 为退款的交易号
+	Amount   Money     `json:"amount"`    // 交易金额或者退款金额，均为正数
+	Fee      Money     `json:"fee"`       // 支付渠道收取（退款时为退还）的手续费，均为正数
+	Time     time.Time `json:"time"`      // 交易或者退款完成的时间
+
+	// RawRecord 原始记录，支付宝为 CSV 的一行（中文字段为 GBK 编码），微信支付为文本的一行，PayPal 为 transaction_detail
+	RawRecord interface{} `json:"raw_record"`
+}
+
+// billDay 返回 date 所在日期在 loc 时区的开始及结束时间，只使用 date 的年月日
+func billDay(date time.Time, loc *time.Location) (start, end time.Time) {
+	start = time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, loc)
+	return start, start.AddDate(0, 0, 1)
+}
+
+// parseBillMoney 解析对账单中的金额，退款及手续费在对账单中可能为负数，统一转换为正数。
+// 微信支付的手续费精确到小数点后 5 位，超出货币精度的部分四舍五入
+func parseBillMoney(s, currency string) (Money, error) {
+	s = strings.TrimLeft(strings.TrimSpace(s), "+-")
+	if s == "" {
+		return NewMoney(0, currency), nil
+	}
+
+	var roundUp = false
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		var exp = currencyExponent(currency)
+		if frac := s[i+1:]; len(frac) > exp {
+			roundUp = frac[exp] >= '5' && frac[exp] <= '9'
+			s = s[:i+1+exp]
+		}
+	}
+
+	m, err := ParseMoney(s, currency)
+	if err != nil {
+		return m, err
+	}
+	if roundUp {
+		m.Amount++
+	}
+	return m, nil
+}
+
+// downloadBill 下载支付渠道提供的对账单文件
+func downloadBill(ctx context.Context, url string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("下载对账单失败: %s", rsp.Status)
+	}
+	return ioutil.ReadAll(rsp.Body)
+}
+
+func (this *Service) DownloadBill(channel string, date time.Time) (result *Bill, err error) {
+	return this.DownloadBillContext(context.Background(), channel, date)
+}
+
+// DownloadBillContext 下载支付渠道的对账单，只使用 date 的年月日，按照支付渠道所在的时区计算（支付宝及微信支付为北京时间，PayPal 为 UTC）
+func (this *Service) DownloadBillContext(ctx context.Context, channel string, date time.Time) (result *Bill, err error) {
+	var p = this.getChannel(channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	if err = p.Capability().validateFeature(channel, K_FEATURE_DOWNLOAD_BILL); err != nil {
+		return nil, err
+	}
+	return p.DownloadBillContext(ctx, date)
+}
+
+// ReconcileItem 对账结果中的一条差异
+type ReconcileItem struct {
+	OrderNo string         `json:"order_no"`
+	Bill    *BillRecord    `json:"bill,omitempty"`    // 对账单中的记录，Extra 时为空
+	Payment *PaymentRecord `json:"payment,omitempty"` // Store 中的订单，Missing 时可能为空
+}
+
+// ReconcileReport 对账结果，只核对支付记录，退款记录需要结合业务系统核对
+type ReconcileReport struct {
+	Channel    string           `json:"channel"`
+	Start      time.Time        `json:"start"`
+	End        time.Time        `json:"end"`
+	Matched    int              `json:"matched"`    // 金额一致的订单数量
+	Missing    []*ReconcileItem `json:"missing"`    // 对账单中已支付，Store 中不存在或者不是已支付状态的订单
+	Extra      []*ReconcileItem `json:"extra"`      // Store 中已支付，对账单中不存在的订单
+	Mismatched []*ReconcileItem `json:"mismatched"` // 对账单中的金额与 Store 中的订单金额不一致的订单
+}
+
+// Balanced 是否没有任何差异
+func (this *ReconcileReport) Balanced() bool {
+	return len(this.Missing) == 0 && len(this.Extra) == 0 && len(this.Mismatched) == 0
+}
+
+func (this *Service) Reconcile(channel string, date time.Time) (result *ReconcileReport, err error) {
+	return this.ReconcileContext(context.Background(), channel, date)
+}
+
+// ReconcileContext 下载对账单并与 Store 中的订单核对。
+// Store 中的订单按照创建时间筛选，在对账单日期之前创建、之后才支付的订单会出现在 Missing 中，
+// 在对账单日期之内创建、次日才支付的订单会出现在 Extra 中，需要结合相邻日期的对账结果判断。
+func (this *Service) ReconcileContext(ctx context.Context, channel string, date time.Time) (result *ReconcileReport, err error) {
+	var store = this.getStore()
+	if store == nil {
+		return nil, ErrStoreNotSet
+	}
+
+	bill, err := this.DownloadBillContext(ctx, channel, date)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &ReconcileReport{}
+	result.Channel = channel
+	result.Start = bill.Start
+	result.End = bill.End
+
+	var billed = make(map[string]struct{})
+	for _, record := range bill.Records {
+		if record.Type != K_BILL_TYPE_TRADE {
+			continue
+		}
+		billed[record.OrderNo] = struct{}{}
+
+		payment, err := store.GetPayment(ctx, channel, record.OrderNo)
+		if err != nil && err != ErrPaymentNotFound {
+			return nil, err
+		}
+
+		var item = &ReconcileItem{OrderNo: record.OrderNo, Bill: record, Payment: payment}
+		switch {
+		case payment == nil || !isPaidState(payment.Status):
+			result.Missing = append(result.Missing, item)
+		case !payment.Amount.Equal(record.Amount):
+			result.Mismatched = append(result.Mismatched, item)
+		default:
+			result.Matched++
+		}
+	}
+
+	var query = &PaymentQuery{}
+	query.Channel = channel
+	query.Statuses = []string{K_ORDER_STATE_PAID, K_ORDER_STATE_PARTIALLY_REFUNDED, K_ORDER_STATE_REFUNDED}
+	query.CreatedAfter = bill.Start
+	query.CreatedBefore = bill.End
+	payments, err := store.FindPayments(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	for _, payment := range payments {
+		if _, ok := billed[payment.OrderNo]; !ok {
+			result.Extra = append(result.Extra, &ReconcileItem{OrderNo: payment.OrderNo, Payment: payment})
+		}
+	}
+	return result, nil
+}
+
+func isPaidState(state string) bool {
+	return state == K_ORDER_STATE_PAID || state == K_ORDER_STATE_PARTIALLY_REFUNDED || state == K_ORDER_STATE_REFUNDED
+}
@@ -0,0 +1,37 @@
+package pay4go
+
+import "testing"
+
+func TestParseBillMoney(t *testing.T) {
+	var tests = []struct {
+		s        string
+		currency string
+		amount   int64
+		err      error
+	}{
+		{"12.34", K_CURRENCY_CNY, 1234, nil},
+		{"-12.34", K_CURRENCY_CNY, 1234, nil},
+		{"+0.01", K_CURRENCY_CNY, 1, nil},
+		{"", K_CURRENCY_CNY, 0, nil},
+		{" ", K_CURRENCY_CNY, 0, nil},
+		{"0.00500", K_CURRENCY_CNY, 1, nil},
+		{"-0.00500", K_CURRENCY_CNY, 1, nil},
+		{"0.00499", K_CURRENCY_CNY, 0, nil},
+		{"1.23456", K_CURRENCY_CNY, 123, nil},
+		{"1.99500", K_CURRENCY_CNY, 200, nil},
+		{"100.4", "JPY", 100, nil},
+		{"100.5", "JPY", 101, nil},
+		{"abc", K_CURRENCY_CNY, 0, ErrInvalidMoney},
+	}
+
+	for _, test := range tests {
+		m, err := parseBillMoney(test.s, test.currency)
+		if err != test.err {
+			t.Errorf("parseBillMoney(%q, %q) 错误为 %v，期望 %v", test.s, test.currency, err, test.err)
+			continue
+		}
+		if err == nil && (m.Amount != test.amount || m.Currency != test.currency) {
+			t.Errorf("parseBillMoney(%q, %q) = %+v，期望 %d", test.s, test.currency, m, test.amount)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package pay4go
+
+import "strings"
+
+const (
+	K_FEATURE_QUERY_BY_ORDER_NO = "query_by_order_no" // 通过订单编号查询交易
+	K_FEATURE_REFUND            = "refund"            // 退款
+	K_FEATURE_REFUND_QUERY      = "refund_query"      // 查询单笔退款
+	K_FEATURE_REFUND_LIST       = "refund_list"       // 查询订单的全部退款
+	K_FEATURE_CLOSE_TRADE       = "close_trade"       // 关闭交易
+	K_FEATURE_DOWNLOAD_BILL     = "download_bill"     // 下载对账单
+)
+
+// Capability 支付渠道支持的支付方式、货币及功能
+type Capability struct {
+	DefaultTradeMethod string   // Order.TradeMethod 为空时使用的支付方式，为空表示必须指定支付方式
+	TradeMethods       []string // 支持的支付方式
+	Currencies         []string // 支持的货币，为空表示不限制
+	Features           []string // 支持的功能
+}
+
+func (this *Capability) SupportTradeMethod(method string) bool {
+	return contains(this.TradeMethods, method)
+}
+
+func (this *Capability) SupportCurrency(currency string) bool {
+	if len(this.Currencies) == 0 {
+		return true
+	}
+	for _, c := range this.Currencies {
+		if strings.EqualFold(c, currency) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Capability) SupportFeature(feature string) bool {
+	return contains(this.Features, feature)
+}
+
+// validateOrder 验证支付渠道是否支持该订单的支付方式及货币
+func (this *Capability) validateOrder(channel string, order *Order) error {
+	var method = order.TradeMethod
+	if method == "" {
+		method = this.DefaultTradeMethod
+	}
+	if method == "" || !this.SupportTradeMethod(method) {
+		return &CapabilityError{Channel: channel, Kind: K_CAPABILITY_TRADE_METHOD, Value: order.TradeMethod}
+	}
+	if order.Currency != "" && !this.SupportCurrency(order.Currency) {
+		return &CapabilityError{Channel: channel, Kind: K_CAPABILITY_CURRENCY, Value: order.Currency}
+	}
+	return nil
+}
+
+func (this *Capability) validateFeature(channel, feature string) error {
+	if !this.SupportFeature(feature) {
+		return &CapabilityError{Channel: channel, Kind: K_CAPABILITY_FEATURE, Value: feature}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
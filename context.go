@@ -0,0 +1,52 @@
+package pay4go
+
+import (
+	"context"
+	"time"
+)
+
+// call 执行 fn 并等待其返回，如果在此之前 ctx 被取消或者超时，则立即返回 ctx.Err()。
+// 底层的 SDK 不支持 context，ctx 被取消之后执行 fn 的 goroutine 会继续运行，直到请求返回或者 SDK 的 http.Client 超时，其结果会被丢弃。
+// 只能用于查询等不改变支付渠道状态的请求，fn 不能访问调用者返回之后会失效的数据（例如 *http.Request）。
+func call(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	var done = make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// invoke 在 ctx 没有被取消时执行 fn 并等待其返回，fn 开始执行之后不能被取消。
+// 用于创建交易、退款、关闭交易等改变支付渠道状态的请求，避免请求在支付渠道已经完成而调用者得到的是 ctx.Err()。
+func invoke(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// sleep 等待 d 时长，如果在此之前 ctx 被取消或者超时，则立即返回 ctx.Err()
+func sleep(ctx context.Context, d time.Duration) error {
+	var timer = time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -1,13 +1,80 @@
 package pay4go
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	ErrUnknownChannel      = errors.New("未知的支付渠道")
 	ErrUnknownNotification = errors.New("未知的通知")
 	ErrUnknownTradeNo      = errors.New("未知的交易号")
+	ErrUnknownRefundNo     = errors.New("未知的退款单号")
+	ErrPaymentNotFound     = errors.New("订单不存在")
+	ErrPaymentExists       = errors.New("订单已经存在")
+	ErrPaymentStateChanged = errors.New("订单状态已经改变")
+	ErrStoreNotSet         = errors.New("没有设置 Store")
+	ErrInvalidMoney        = errors.New("无效的金额")
+	ErrTradeTimeout        = errors.New("等待用户支付超时")
+	ErrTradeReverseFailed  = errors.New("撤销交易失败")
+	ErrTradeClosed         = errors.New("交易已关闭")
+	ErrAmountMismatch      = errors.New("金额与订单金额不一致")
+	ErrNotifyProcessing    = errors.New("通知正在处理中")
 
 	ErrAliPayNotAllowed = errors.New("支付宝 暂时不支持")
 	ErrWXPayNotAllowed  = errors.New("微信支付 暂时不支持")
 	ErrPayPalNotAllowed = errors.New("PayPal 暂时不支持")
+
+	ErrPayPalApprovalURLNotFound = errors.New("PayPal 没有返回支付链接")
+)
+
+const (
+	K_CAPABILITY_TRADE_METHOD = "trade_method"
+	K_CAPABILITY_CURRENCY     = "currency"
+	K_CAPABILITY_FEATURE      = "feature"
 )
+
+// CapabilityError 支付渠道不支持指定的支付方式、货币或者功能
+type CapabilityError struct {
+	Channel string
+	Kind    string // K_CAPABILITY_TRADE_METHOD、K_CAPABILITY_CURRENCY 或者 K_CAPABILITY_FEATURE
+	Value   string
+}
+
+// StateTransitionError 订单状态变更不合法
+type StateTransitionError struct {
+	Channel string
+	OrderNo string
+	From    string
+	To      string
+}
+
+func (this *StateTransitionError) Error() string {
+	return fmt.Sprintf("%s 订单 %s 的状态不能从 %q 变更为 %q", this.Channel, this.OrderNo, this.From, this.To)
+}
+
+// TradeReverseError 当面付支付失败或者超时之后撤销交易失败，用户之后仍然可能完成支付
+type TradeReverseError struct {
+	Channel    string
+	OrderNo    string
+	Err        error // 支付失败的原因
+	ReverseErr error // 撤销交易失败的原因
+}
+
+func (this *TradeReverseError) Error() string {
+	return fmt.Sprintf("%s 订单 %s 支付失败: %v，撤销交易失败: %v", this.Channel, this.OrderNo, this.Err, this.ReverseErr)
+}
+
+func (this *TradeReverseError) Unwrap() error {
+	return this.Err
+}
+
+func (this *CapabilityError) Error() string {
+	switch this.Kind {
+	case K_CAPABILITY_TRADE_METHOD:
+		return fmt.Sprintf("%s 不支持该支付方式: %q", this.Channel, this.Value)
+	case K_CAPABILITY_CURRENCY:
+		return fmt.Sprintf("%s 不支持该货币: %q", this.Channel, this.Value)
+	}
+	return fmt.Sprintf("%s 不支持该功能: %q", this.Channel, this.Value)
+}
@@ -0,0 +1,164 @@
+package pay4go
+
+import "context"
+
+const (
+	K_EVENT_TYPE_TRADE_PAID   = "trade_paid"
+	K_EVENT_TYPE_TRADE_CLOSED = "trade_closed"
+	K_EVENT_TYPE_REFUND       = "refund"
+	K_EVENT_TYPE_DISPUTE      = "dispute"
+
+	K_EVENT_TYPE_STATE_CHANGED = "state_changed"
+)
+
+type Event struct {
+	Type    string `json:"type"`
+	Channel string `json:"channel"`
+	OrderNo string `json:"order_no"`
+	TradeNo string `json:"trade_no"`
+	From    string `json:"from,omitempty"` // 变更前的订单状态，只有订单状态变更事件才有值
+	To      string `json:"to,omitempty"`   // 变更后的订单状态，只有订单状态变更事件才有值
+
+	Trade        *Trade        `json:"trade,omitempty"`        // 交易信息，由通知触发时只有开启了 Service.AttachTrade 才有值
+	Notification *Notification `json:"notification,omitempty"` // 触发该事件的通知，由同步返回或者主动调用触发时为空，由 TradePoller 触发时根据交易信息生成
+}
+
+// EventHandler 处理事件，由通知触发的事件处理失败时，会通知支付渠道稍后重新发送该通知
+type EventHandler func(ctx context.Context, event *Event) error
+
+// OnTradePaid 订阅支付成功事件，由通知、同步返回及 TradePoller 触发。
+// 设置了 NotifyStore 时同一订单只会成功分发一次，处理失败时可以由之后的通知再次触发；没有设置时同一笔交易可能会触发多次
+func (this *Service) OnTradePaid(fn EventHandler) {
+	this.subscribe(K_EVENT_TYPE_TRADE_PAID, fn)
+}
+
+// OnTradeClosed 订阅交易关闭事件
+func (this *Service) OnTradeClosed(fn EventHandler) {
+	this.subscribe(K_EVENT_TYPE_TRADE_CLOSED, fn)
+}
+
+// OnRefund 订阅退款事件，由退款通知触发
+func (this *Service) OnRefund(fn EventHandler) {
+	this.subscribe(K_EVENT_TYPE_REFUND, fn)
+}
+
+// OnDispute 订阅争议事件，由争议通知触发（PayPal）
+func (this *Service) OnDispute(fn EventHandler) {
+	this.subscribe(K_EVENT_TYPE_DISPUTE, fn)
+}
+
+func (this *Service) subscribe(eventType string, fn EventHandler) {
+	if fn == nil {
+		return
+	}
+	this.mu.Lock()
+	this.handlers[eventType] = append(this.handlers[eventType], fn)
+	this.mu.Unlock()
+}
+
+// emit 依次调用订阅了该事件的处理函数，遇到错误时立即返回
+func (this *Service) emit(ctx context.Context, event *Event) error {
+	this.mu.RLock()
+	var handlers = this.handlers[event.Type]
+	this.mu.RUnlock()
+
+	for _, fn := range handlers {
+		if err := fn(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emitTradePaid 使用 NotifyStore 对支付成功事件去重，没有设置 NotifyStore 时直接分发
+func (this *Service) emitTradePaid(ctx context.Context, event *Event) (err error) {
+	var notifyStore = this.getNotifyStore()
+	var key = tradePaidKey(event)
+	if notifyStore == nil || key == "" {
+		return this.emit(ctx, event)
+	}
+
+	ok, err := notifyStore.Reserve(ctx, key)
+	if err != nil || !ok {
+		return err
+	}
+	if err = this.emit(ctx, event); err != nil {
+		// 请求可能已经被取消，使用新的 Context 确保能够取消标记
+		notifyStore.Release(context.Background(), key)
+		return err
+	}
+	return notifyStore.Confirm(ctx, key)
+}
+
+// tradePaidKey 由支付渠道、事件类型及订单号（没有订单号时使用渠道交易号）组成
+func tradePaidKey(event *Event) string {
+	var no = event.OrderNo
+	if no == "" {
+		no = event.TradeNo
+	}
+	if no == "" {
+		return ""
+	}
+	return event.Channel + "/" + event.Type + "/" + no
+}
+
+func newTradeEvent(eventType string, trade *Trade) *Event {
+	var event = &Event{}
+	event.Type = eventType
+	event.Channel = trade.Channel
+	event.OrderNo = trade.OrderNo
+	event.TradeNo = trade.TradeNo
+	event.Trade = trade
+	return event
+}
+
+// queryTrade 优先使用渠道交易号查询交易信息
+func (this *Service) queryTrade(ctx context.Context, p PayChannel, tradeNo, orderNo string) (*Trade, error) {
+	if tradeNo != "" {
+		return p.GetTradeContext(ctx, tradeNo)
+	}
+	return p.GetTradeWithOrderNoContext(ctx, orderNo)
+}
+
+// dispatchNotification 将通知转换为对应的事件进行分发，交易通知根据通知中的交易状态确认支付结果，
+// 通知附带了重新查询的交易信息时以查询结果为准
+func (this *Service) dispatchNotification(ctx context.Context, noti *Notification) error {
+	var event *Event
+
+	switch noti.NotifyType {
+	case K_NOTIFY_TYPE_TRADE:
+		var status = noti.Status
+		if noti.Trade != nil {
+			status = noti.Trade.Status
+		}
+		switch status {
+		case K_TRADE_STATUS_PAID:
+			event = &Event{Type: K_EVENT_TYPE_TRADE_PAID}
+		case K_TRADE_STATUS_CLOSED:
+			event = &Event{Type: K_EVENT_TYPE_TRADE_CLOSED}
+		default:
+			return nil
+		}
+		if noti.Trade != nil {
+			event.TradeNo = noti.Trade.TradeNo
+			event.Trade = noti.Trade
+		}
+	case K_NOTIFY_TYPE_REFUND:
+		event = &Event{Type: K_EVENT_TYPE_REFUND}
+	case K_NOTIFY_TYPE_DISPUTE:
+		event = &Event{Type: K_EVENT_TYPE_DISPUTE}
+	default:
+		return nil
+	}
+
+	event.Channel = noti.Channel
+	event.OrderNo = noti.OrderNo
+	if event.TradeNo == "" {
+		event.TradeNo = noti.TradeNo
+	}
+	event.Notification = noti
+	if event.Type == K_EVENT_TYPE_TRADE_PAID {
+		return this.emitTradePaid(ctx, event)
+	}
+	return this.emit(ctx, event)
+}
@@ -0,0 +1,199 @@
+package pay4go
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	k_EXPIRY_INTERVAL   = time.Minute
+	k_EXPIRY_BATCH_SIZE = 100
+	k_EXPIRY_MAX_DELAY  = time.Hour
+)
+
+// ExpiryScheduler 定期检查 Store 中已经过期但仍未支付的订单，向支付渠道确认仍未支付之后关闭该订单，
+// 订单状态依次变更为 expired 和 closed。订单的过期时间由 Order.Timeout 及支付渠道的限制决定。
+type ExpiryScheduler struct {
+	Interval  time.Duration                          // 检查的时间间隔，默认为 1 分钟
+	BatchSize int                                    // 每次最多处理的订单数量（不包括处于延迟中的订单），默认为 100
+	OnError   func(record *PaymentRecord, err error) // 处理订单出错时调用，该订单会延迟一段时间之后重新处理
+
+	service *Service
+	mu      sync.Mutex
+	failed  map[string]*pollState
+}
+
+func NewExpiryScheduler(service *Service) *ExpiryScheduler {
+	var s = &ExpiryScheduler{}
+	s.service = service
+	s.Interval = k_EXPIRY_INTERVAL
+	s.BatchSize = k_EXPIRY_BATCH_SIZE
+	s.failed = make(map[string]*pollState)
+	return s
+}
+
+// Run 定期检查过期的订单，直到 ctx 被取消
+func (this *ExpiryScheduler) Run(ctx context.Context) error {
+	if this.service.getStore() == nil {
+		return ErrStoreNotSet
+	}
+
+	var interval = this.Interval
+	if interval <= 0 {
+		interval = k_EXPIRY_INTERVAL
+	}
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := this.RunOnce(ctx); err != nil && ctx.Err() == nil && this.OnError != nil {
+			this.OnError(nil, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce 检查一次过期的订单
+func (this *ExpiryScheduler) RunOnce(ctx context.Context) error {
+	var store = this.service.getStore()
+	if store == nil {
+		return ErrStoreNotSet
+	}
+
+	var now = time.Now()
+	var query = &PaymentQuery{}
+	query.Statuses = []string{K_ORDER_STATE_CREATED, K_ORDER_STATE_PENDING, K_ORDER_STATE_EXPIRED}
+	query.ExpiresBefore = now
+
+	var batchSize = this.BatchSize
+	if batchSize <= 0 {
+		batchSize = k_EXPIRY_BATCH_SIZE
+	}
+
+	// 处理失败的订单会延迟一段时间再处理，不占用 batchSize，所以需要遍历全部过期的订单
+	records, err := findAllPayments(ctx, store, query)
+	if err != nil {
+		return err
+	}
+
+	var expired = make(map[string]struct{}, len(records))
+	var processed = 0
+	for _, record := range records {
+		var key = paymentKey(record.Channel, record.OrderNo)
+		expired[key] = struct{}{}
+		if processed >= batchSize || this.delayed(key, now) {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		processed++
+		if err = this.expire(ctx, record); err != nil {
+			this.fail(key, now)
+			if this.OnError != nil {
+				this.OnError(record, err)
+			}
+		} else {
+			this.succeed(key)
+		}
+	}
+	this.prune(expired)
+	return nil
+}
+
+// delayed 返回订单是否因为之前处理失败而需要延迟处理
+func (this *ExpiryScheduler) delayed(key string, now time.Time) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var s = this.failed[key]
+	return s != nil && now.Before(s.next)
+}
+
+// fail 记录订单处理失败，延迟时间从 Interval 开始按倍数增加，直到 1 小时
+func (this *ExpiryScheduler) fail(key string, now time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var s = this.failed[key]
+	if s == nil {
+		s = &pollState{}
+		this.failed[key] = s
+	}
+
+	var delay = this.Interval
+	if delay <= 0 {
+		delay = k_EXPIRY_INTERVAL
+	}
+	for i := 0; i < s.attempts && delay < k_EXPIRY_MAX_DELAY; i++ {
+		delay *= 2
+	}
+	if delay > k_EXPIRY_MAX_DELAY {
+		delay = k_EXPIRY_MAX_DELAY
+	}
+	s.attempts++
+	s.next = now.Add(delay)
+}
+
+func (this *ExpiryScheduler) succeed(key string) {
+	this.mu.Lock()
+	delete(this.failed, key)
+	this.mu.Unlock()
+}
+
+// prune 删除已经不需要处理的订单的失败记录
+func (this *ExpiryScheduler) prune(expired map[string]struct{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for key := range this.failed {
+		if _, ok := expired[key]; !ok {
+			delete(this.failed, key)
+		}
+	}
+}
+
+func (this *ExpiryScheduler) expire(ctx context.Context, record *PaymentRecord) error {
+	// 查询交易信息时会同时更新订单状态，已经支付或者已经关闭的订单不需要再处理。
+	// 查询失败时（例如用户没有扫码，支付宝中不存在该交易）仍然尝试关闭，已经支付的订单在支付渠道会关闭失败
+	trade, err := this.service.queryPayment(ctx, record)
+	if err == nil && trade != nil {
+		if state := orderStateWithTradeStatus(trade.Status); state != "" && state != K_ORDER_STATE_PENDING {
+			return nil
+		}
+	}
+
+	if record.Status != K_ORDER_STATE_EXPIRED {
+		if err = this.service.transit(ctx, &PaymentRecord{Channel: record.Channel, OrderNo: record.OrderNo, Status: K_ORDER_STATE_EXPIRED}); err != nil {
+			return err
+		}
+	}
+
+	err = this.service.CloseTradeContext(ctx, record.Channel, record.OrderNo)
+	if err != nil && record.Status == K_ORDER_STATE_CREATED {
+		// 订单可能没有在支付渠道创建成功，只需要关闭本地的订单
+		return this.service.transit(ctx, &PaymentRecord{Channel: record.Channel, OrderNo: record.OrderNo, Status: K_ORDER_STATE_CLOSED})
+	}
+	return err
+}
+
+// queryPayment 查询订单在支付渠道的交易信息，支付渠道不支持通过订单号查询并且没有渠道交易号时返回 nil
+func (this *Service) queryPayment(ctx context.Context, record *PaymentRecord) (*Trade, error) {
+	var p = this.getChannel(record.Channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	if p.Capability().SupportFeature(K_FEATURE_QUERY_BY_ORDER_NO) {
+		return this.GetTradeWithOrderNoContext(ctx, record.Channel, record.OrderNo)
+	}
+	if record.TradeNo != "" {
+		return this.GetTradeContext(ctx, record.Channel, record.TradeNo)
+	}
+	return nil, nil
+}
@@ -0,0 +1,33 @@
+package pay4go
+
+import (
+	"context"
+	"net/http"
+)
+
+// NotifyHandlerFunc 处理支付渠道的通知，返回 nil 表示处理成功，返回错误时支付渠道会在之后重新发送该通知
+type NotifyHandlerFunc func(ctx context.Context, noti *Notification) error
+
+type notifyHandler struct {
+	service *Service
+	fn      NotifyHandlerFunc
+}
+
+// NotifyHandler 返回用于接收支付渠道通知的 http.Handler。
+// 通知验证通过之后会调用 fn，并根据验证及 fn 的结果向支付渠道写入其要求的响应内容，重复的通知不会调用 fn。
+func (this *Service) NotifyHandler(fn NotifyHandlerFunc) http.Handler {
+	return &notifyHandler{service: this, fn: fn}
+}
+
+func (this *notifyHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+
+	var p = this.service.getChannel(req.FormValue("channel"))
+	if p == nil {
+		http.Error(w, ErrUnknownChannel.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err := this.service.handleNotification(req, this.fn)
+	p.WriteNotifyResponse(w, err)
+}
@@ -0,0 +1,132 @@
+package pay4go
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	K_CURRENCY_CNY = "CNY"
+	K_CURRENCY_USD = "USD"
+)
+
+// currencyExponents 小数位数不是 2 的货币
+var currencyExponents = map[string]int{
+	"JPY": 0,
+	"KRW": 0,
+	"HUF": 0,
+	"TWD": 0,
+}
+
+func currencyExponent(currency string) int {
+	if e, ok := currencyExponents[strings.ToUpper(currency)]; ok {
+		return e
+	}
+	return 2
+}
+
+// Money 金额，使用货币的最小单位（例如：分、美分）保存，避免浮点数带来的精度问题
+type Money struct {
+	Amount   int64  `json:"amount"`   // 以最小货币单位表示的金额
+	Currency string `json:"currency"` // 货币名称，例如 CNY、USD
+}
+
+func NewMoney(amount int64, currency string) Money {
+	return Money{Amount: amount, Currency: currency}
+}
+
+// ParseMoney 解析以主货币单位表示的金额字符串，例如 "12.34"
+func ParseMoney(s, currency string) (Money, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Money{}, ErrInvalidMoney
+	}
+
+	var negative = false
+	if s[0] == '-' || s[0] == '+' {
+		negative = s[0] == '-'
+		s = s[1:]
+	}
+
+	var exp = currencyExponent(currency)
+	var intPart, fracPart = s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, fracPart = s[:i], s[i+1:]
+	}
+	fracPart = strings.TrimRight(fracPart, "0")
+	if intPart == "" || len(fracPart) > exp {
+		return Money{}, ErrInvalidMoney
+	}
+	fracPart = fracPart + strings.Repeat("0", exp-len(fracPart))
+
+	amount, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil || amount < 0 {
+		return Money{}, ErrInvalidMoney
+	}
+	if negative {
+		amount = -amount
+	}
+	return NewMoney(amount, currency), nil
+}
+
+func MustParseMoney(s, currency string) Money {
+	m, err := ParseMoney(s, currency)
+	if err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// String 返回以主货币单位表示的金额字符串，例如 "12.34"
+func (this Money) String() string {
+	var exp = currencyExponent(this.Currency)
+	var amount = this.Amount
+	var sign = ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if exp == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+
+	var base int64 = 1
+	for i := 0; i < exp; i++ {
+		base *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/base, exp, amount%base)
+}
+
+// Add 金额相加，调用方需要保证两个金额的货币相同
+func (this Money) Add(m Money) Money {
+	var currency = this.Currency
+	if currency == "" {
+		currency = m.Currency
+	}
+	return NewMoney(this.Amount+m.Amount, currency)
+}
+
+// Sub 金额相减，调用方需要保证两个金额的货币相同
+func (this Money) Sub(m Money) Money {
+	return this.Add(NewMoney(-m.Amount, m.Currency))
+}
+
+func (this Money) Mul(n int) Money {
+	return NewMoney(this.Amount*int64(n), this.Currency)
+}
+
+func (this Money) IsZero() bool {
+	return this.Amount == 0
+}
+
+// Equal 比较金额及货币是否相同，货币为空时只比较金额
+func (this Money) Equal(m Money) bool {
+	if this.Amount != m.Amount {
+		return false
+	}
+	if this.Currency == "" || m.Currency == "" {
+		return true
+	}
+	return strings.EqualFold(this.Currency, m.Currency)
+}
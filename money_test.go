@@ -0,0 +1,58 @@
+package pay4go
+
+import "testing"
+
+func TestParseMoney(t *testing.T) {
+	var tests = []struct {
+		s        string
+		currency string
+		amount   int64
+		err      error
+	}{
+		{"12.34", K_CURRENCY_CNY, 1234, nil},
+		{"12.3", K_CURRENCY_CNY, 1230, nil},
+		{"12", K_CURRENCY_USD, 1200, nil},
+		{"0.01", K_CURRENCY_USD, 1, nil},
+		{" 1.50 ", K_CURRENCY_CNY, 150, nil},
+		{"12.340", K_CURRENCY_CNY, 1234, nil},
+		{"-3.21", K_CURRENCY_CNY, -321, nil},
+		{"+3.21", K_CURRENCY_CNY, 321, nil},
+		{"100", "JPY", 100, nil},
+		{"100", "jpy", 100, nil},
+		{"1.5", "JPY", 0, ErrInvalidMoney},
+		{"1.234", K_CURRENCY_CNY, 0, ErrInvalidMoney},
+		{"", K_CURRENCY_CNY, 0, ErrInvalidMoney},
+		{".5", K_CURRENCY_CNY, 0, ErrInvalidMoney},
+		{"abc", K_CURRENCY_CNY, 0, ErrInvalidMoney},
+		{"1.-5", K_CURRENCY_CNY, 0, ErrInvalidMoney},
+	}
+
+	for _, test := range tests {
+		m, err := ParseMoney(test.s, test.currency)
+		if err != test.err {
+			t.Errorf("ParseMoney(%q, %q) 错误为 %v，期望 %v", test.s, test.currency, err, test.err)
+			continue
+		}
+		if err == nil && (m.Amount != test.amount || m.Currency != test.currency) {
+			t.Errorf("ParseMoney(%q, %q) = %+v，期望 %d", test.s, test.currency, m, test.amount)
+		}
+	}
+}
+
+func TestMoneyString(t *testing.T) {
+	var tests = []struct {
+		m Money
+		s string
+	}{
+		{NewMoney(1234, K_CURRENCY_CNY), "12.34"},
+		{NewMoney(5, K_CURRENCY_USD), "0.05"},
+		{NewMoney(-150, K_CURRENCY_USD), "-1.50"},
+		{NewMoney(100, "JPY"), "100"},
+	}
+
+	for _, test := range tests {
+		if s := test.m.String(); s != test.s {
+			t.Errorf("%+v.String() = %q，期望 %q", test.m, s, test.s)
+		}
+	}
+}
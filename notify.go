@@ -0,0 +1,100 @@
+package pay4go
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// k_NOTIFY_RESERVE_TIMEOUT 通知处理超时时间，超过该时间仍未处理完成的通知可以被重新处理，避免进程退出之后该通知永远无法处理
+	k_NOTIFY_RESERVE_TIMEOUT = 5 * time.Minute
+)
+
+// NotifyStore 记录通知的处理状态，用于通知去重，key 由支付渠道、通知类型及通知的唯一标识组成，
+// 支付成功事件的 key 由支付渠道、事件类型及订单号组成
+type NotifyStore interface {
+	// Reserve 标记通知开始处理，通知已经处理完成时返回 false，正在处理时返回 ErrNotifyProcessing
+	Reserve(ctx context.Context, key string) (bool, error)
+
+	// Confirm 标记通知已经处理完成
+	Confirm(ctx context.Context, key string) error
+
+	// Release 通知处理失败，取消标记，支付渠道重新发送该通知时可以再次处理
+	Release(ctx context.Context, key string) error
+}
+
+// SetNotifyStore 设置用于通知及支付成功事件去重的 NotifyStore，为 nil 时不去重
+func (this *Service) SetNotifyStore(store NotifyStore) {
+	this.mu.Lock()
+	this.notifyStore = store
+	this.mu.Unlock()
+}
+
+func (this *Service) getNotifyStore() NotifyStore {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.notifyStore
+}
+
+// notifyKey 通知没有唯一标识时返回空字符串，此时不去重
+func notifyKey(noti *Notification) string {
+	if noti.NotifyId == "" {
+		return ""
+	}
+	return noti.Channel + "/" + noti.NotifyType + "/" + noti.NotifyId
+}
+
+type notifyState struct {
+	done       bool
+	reservedAt time.Time
+}
+
+// MemoryNotifyStore 将通知的处理状态保存在内存中，只适用于单机部署，已处理的通知不会被删除
+type MemoryNotifyStore struct {
+	mu    sync.Mutex
+	notis map[string]*notifyState
+}
+
+func NewMemoryNotifyStore() *MemoryNotifyStore {
+	var s = &MemoryNotifyStore{}
+	s.notis = make(map[string]*notifyState)
+	return s
+}
+
+func (this *MemoryNotifyStore) Reserve(ctx context.Context, key string) (bool, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if s := this.notis[key]; s != nil {
+		if s.done {
+			return false, nil
+		}
+		if time.Since(s.reservedAt) < k_NOTIFY_RESERVE_TIMEOUT {
+			return false, ErrNotifyProcessing
+		}
+	}
+	this.notis[key] = &notifyState{reservedAt: time.Now()}
+	return true, nil
+}
+
+func (this *MemoryNotifyStore) Confirm(ctx context.Context, key string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if s := this.notis[key]; s != nil {
+		s.done = true
+	}
+	return nil
+}
+
+func (this *MemoryNotifyStore) Release(ctx context.Context, key string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// 已经处理完成的通知不能取消标记，与 SQLStore 保持一致
+	if s := this.notis[key]; s != nil && !s.done {
+		delete(this.notis, key)
+	}
+	return nil
+}
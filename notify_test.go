@@ -0,0 +1,47 @@
+package pay4go
+
+import (
+	"context"
+	"testing"
+)
+
+// testNotifyStore 同时用于 MemoryNotifyStore 和 SQLStore
+func testNotifyStore(t *testing.T, s NotifyStore) {
+	var ctx = context.Background()
+
+	var steps = []struct {
+		op  string
+		key string
+		ok  bool
+		err error
+	}{
+		{"reserve", "n1", true, nil},
+		{"reserve", "n1", false, ErrNotifyProcessing}, // 正在处理
+		{"release", "n1", false, nil},
+		{"reserve", "n1", true, nil}, // 处理失败之后可以再次处理
+		{"confirm", "n1", false, nil},
+		{"reserve", "n1", false, nil}, // 已经处理完成
+		{"release", "n1", false, nil}, // 已经处理完成的通知不能取消标记
+		{"reserve", "n1", false, nil},
+		{"reserve", "n2", true, nil},
+	}
+	for i, step := range steps {
+		var ok bool
+		var err error
+		switch step.op {
+		case "reserve":
+			ok, err = s.Reserve(ctx, step.key)
+		case "confirm":
+			err = s.Confirm(ctx, step.key)
+		case "release":
+			err = s.Release(ctx, step.key)
+		}
+		if ok != step.ok || err != step.err {
+			t.Fatalf("%d: %s(%q) = %v, %v，期望 %v, %v", i, step.op, step.key, ok, err, step.ok, step.err)
+		}
+	}
+}
+
+func TestMemoryNotifyStore(t *testing.T) {
+	testNotifyStore(t, NewMemoryNotifyStore())
+}
@@ -1,10 +1,20 @@
 package pay4go
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/smartwalle/ngx"
 	"github.com/smartwalle/paypal"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -13,6 +23,12 @@ const (
 
 type PayPal struct {
 	client              *paypal.PayPal
+	clientId            string
+	secret              string
+	isProduction        bool
+	mu                  sync.Mutex
+	closedOrders        map[string]time.Time
+	store               Store
 	ReturnURL           string // 支付成功之后回调 URL
 	CancelURL           string // 用户取消付款回调 URL
 	WebHookId           string
@@ -22,15 +38,47 @@ type PayPal struct {
 func NewPayPal(clientId, secret string, isProduction bool) *PayPal {
 	var p = &PayPal{}
 	p.client = paypal.New(clientId, secret, isProduction)
+	p.clientId = clientId
+	p.secret = secret
+	p.isProduction = isProduction
+	p.closedOrders = make(map[string]time.Time)
 	return p
 }
 
+// SetStore 设置用于确认订单是否已经关闭的 Store，执行（execute）Payment 之前会检查订单在 Store 中的状态，
+// 通过 Service.RegisterChannel 注册或者调用 Service.SetStore 时会自动设置为 Service 的 Store
+func (this *PayPal) SetStore(store Store) {
+	this.mu.Lock()
+	this.store = store
+	this.mu.Unlock()
+}
+
 func (this *PayPal) Identifier() string {
 	return K_CHANNEL_PAYPAL
 }
 
-func (this *PayPal) CreateTradeOrder(order *Order) (url string, err error) {
-	// PayPal 不用判断 method
+func (this *PayPal) Capability() *Capability {
+	var c = &Capability{}
+	c.DefaultTradeMethod = K_TRADE_METHOD_WEB
+	c.TradeMethods = []string{K_TRADE_METHOD_WEB}
+	c.Features = []string{K_FEATURE_REFUND, K_FEATURE_REFUND_QUERY, K_FEATURE_REFUND_LIST, K_FEATURE_CLOSE_TRADE, K_FEATURE_DOWNLOAD_BILL}
+	return c
+}
+
+const (
+	// k_PAYPAL_PAYMENT_EXPIRES 未执行（execute）的 Payment 的有效时间
+	k_PAYPAL_PAYMENT_EXPIRES = time.Hour * 3
+)
+
+func (this *PayPal) CreateTradeOrder(order *Order) (result *PaymentIntent, err error) {
+	return this.CreateTradeOrderContext(context.Background(), order)
+}
+
+func (this *PayPal) CreateTradeOrderContext(ctx context.Context, order *Order) (result *PaymentIntent, err error) {
+	if order.TradeMethod != "" && order.TradeMethod != K_TRADE_METHOD_WEB {
+		return nil, &CapabilityError{Channel: this.Identifier(), Kind: K_CAPABILITY_TRADE_METHOD, Value: order.TradeMethod}
+	}
+
 	var p = &paypal.Payment{}
 	p.Intent = paypal.K_PAYMENT_INTENT_SALE
 
@@ -70,57 +118,81 @@ func (this *PayPal) CreateTradeOrder(order *Order) (url string, err error) {
 	}
 
 	var items = make([]*paypal.Item, 0, 0)
-	var productAmount float64 = 0
-	var productTax float64 = 0
 	for _, p := range order.ProductList {
 		var item = &paypal.Item{}
 		item.Name = p.Name
 		item.Quantity = fmt.Sprintf("%d", p.Quantity)
-		item.Price = fmt.Sprintf("%.2f", p.Price)
-		item.Tax = fmt.Sprintf("%.2f", p.Tax)
+		item.Price = p.Price.String()
+		item.Tax = p.Tax.String()
 		item.SKU = p.SKU
 		item.Currency = order.Currency
 		items = append(items, item)
-
-		productAmount += p.Price * float64(p.Quantity)
-		productTax += p.Tax * float64(p.Quantity)
 	}
 	transaction.ItemList.Items = items
 
-	transaction.Amount.Details.Shipping = fmt.Sprintf("%.2f", order.Shipping)
-	transaction.Amount.Details.ShippingDiscount = fmt.Sprintf("%.2f", order.Discount)
-	transaction.Amount.Details.Tax = fmt.Sprintf("%.2f", productTax)
-	transaction.Amount.Details.Subtotal = fmt.Sprintf("%.2f", productAmount)
-
-	var amount = productAmount + productTax + order.Shipping - order.Discount
-	transaction.Amount.Total = fmt.Sprintf("%.2f", amount)
+	transaction.Amount.Details.Shipping = order.Shipping.String()
+	transaction.Amount.Details.ShippingDiscount = order.Discount.String()
+	transaction.Amount.Details.Tax = order.ProductTax().String()
+	transaction.Amount.Details.Subtotal = order.ProductAmount().String()
+	transaction.Amount.Total = order.TotalAmount().String()
 
 	p.Transactions = []*paypal.Transaction{transaction}
 
-	result, err := this.client.CreatePayment(p)
+	var rsp *paypal.Payment
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.CreatePayment(p)
+		return err
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	for _, link := range result.Links {
+	result = &PaymentIntent{}
+	result.Channel = this.Identifier()
+	result.Kind = K_PAYMENT_KIND_REDIRECT
+	result.OrderNo = order.OrderNo
+	result.TradeNo = rsp.Id
+	result.ExpiresAt = time.Now().Add(k_PAYPAL_PAYMENT_EXPIRES)
+	if order.Timeout > 0 && time.Duration(order.Timeout)*time.Minute < k_PAYPAL_PAYMENT_EXPIRES {
+		result.ExpiresAt = expiresAt(order.Timeout)
+	}
+
+	for _, link := range rsp.Links {
 		if link.Rel == "approval_url" {
-			return link.Href, nil
+			result.Payload = link.Href
+			return result, nil
 		}
 	}
-	return "", err
+	return nil, ErrPayPalApprovalURLNotFound
 }
 
 func (this *PayPal) GetTrade(tradeNo string) (result *Trade, err error) {
-	rsp, err := this.client.GetPaymentDetails(tradeNo)
+	return this.GetTradeContext(context.Background(), tradeNo)
+}
+
+func (this *PayPal) GetTradeContext(ctx context.Context, tradeNo string) (result *Trade, err error) {
+	var rsp *paypal.Payment
+	err = call(ctx, func() (err error) {
+		rsp, err = this.client.GetPaymentDetails(tradeNo)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	if rsp.State == paypal.K_PAYMENT_STATE_CREATED {
-		if paymentRsp, err := this.client.ExecuteApprovedPayment(rsp.Id, rsp.Payer.PayerInfo.PayerId); err != nil {
+	// 用户还没有确认支付时 PayerInfo 为空，不能执行支付
+	var approved = rsp.Payer != nil && rsp.Payer.PayerInfo != nil && rsp.Payer.PayerInfo.PayerId != ""
+	closed, err := this.isClosed(ctx, rsp)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.State == paypal.K_PAYMENT_STATE_CREATED && approved && !closed {
+		err = invoke(ctx, func() (err error) {
+			rsp, err = this.client.ExecuteApprovedPayment(rsp.Id, rsp.Payer.PayerInfo.PayerId)
+			return err
+		})
+		if err != nil {
 			return nil, err
-		} else {
-			rsp = paymentRsp
 		}
 	}
 
@@ -129,12 +201,19 @@ func (this *PayPal) GetTrade(tradeNo string) (result *Trade, err error) {
 	result.RawTrade = rsp
 	result.TradeNo = rsp.Id
 	result.TradeStatus = string(rsp.State)
+	result.Status = tradeStatusWithPayPal(rsp.State)
+	if rsp.State == paypal.K_PAYMENT_STATE_CREATED && closed {
+		result.Status = K_TRADE_STATUS_CLOSED
+	}
+	result.CreatedAt = parseTime(time.RFC3339, rsp.CreateTime, time.UTC)
 
 	if len(rsp.Transactions) > 0 {
 		var trans = rsp.Transactions[0]
 		result.OrderNo = trans.InvoiceNumber
 		if trans.Amount != nil {
-			result.TotalAmount = trans.Amount.Total
+			if result.TotalAmount, err = ParseMoney(trans.Amount.Total, trans.Amount.Currency); err != nil {
+				return nil, err
+			}
 		}
 		if rsp.Payer != nil && rsp.Payer.PayerInfo != nil {
 			result.PayerId = rsp.Payer.PayerInfo.PayerId
@@ -143,24 +222,513 @@ func (this *PayPal) GetTrade(tradeNo string) (result *Trade, err error) {
 		if len(trans.RelatedResources) > 0 {
 			var relatedRes = trans.RelatedResources[0]
 			result.TradeStatus = string(relatedRes.Sale.State)
+			result.Status = saleStatusWithPayPal(relatedRes.Sale.State)
 			if result.TradeStatus == string(paypal.K_SALE_STATE_COMPLETED) {
 				result.TradeSuccess = true
 			}
+			result.PaidAt = parseTime(time.RFC3339, relatedRes.Sale.CreateTime, time.UTC)
+			if fee := relatedRes.Sale.TransactionFee; fee != nil {
+				if result.Fee, err = ParseMoney(fee.Value, fee.Currency); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if result.RefundedAmount, err = refundedAmountOfTransaction(trans, result.TotalAmount.Currency); err != nil {
+			return nil, err
 		}
 	}
+	result.settle()
 	return result, nil
 }
 
+func tradeStatusWithPayPal(state paypal.PaymentState) string {
+	switch state {
+	case paypal.K_PAYMENT_STATE_FAILED:
+		return K_TRADE_STATUS_FAILED
+	case paypal.K_PAYMENT_STATE_CANCELED, paypal.K_PAYMENT_STATE_EXPIRED:
+		return K_TRADE_STATUS_CLOSED
+	}
+	return K_TRADE_STATUS_PENDING
+}
+
+func saleStatusWithPayPal(state paypal.SaleState) string {
+	switch state {
+	case paypal.K_SALE_STATE_COMPLETED:
+		return K_TRADE_STATUS_PAID
+	case paypal.K_SALE_STATE_PARTIALLY_REFUNDED:
+		return K_TRADE_STATUS_PARTIALLY_REFUNDED
+	case paypal.K_SALE_STATE_REFUNDED:
+		return K_TRADE_STATUS_REFUNDED
+	case paypal.K_SALE_STATE_PENDING:
+		return K_TRADE_STATUS_UNDER_REVIEW
+	case paypal.K_SALE_STATE_DENIED:
+		return K_TRADE_STATUS_FAILED
+	}
+	return K_TRADE_STATUS_PENDING
+}
+
 func (this *PayPal) GetTradeWithOrderNo(orderNo string) (result *Trade, err error) {
+	return this.GetTradeWithOrderNoContext(context.Background(), orderNo)
+}
+
+func (this *PayPal) GetTradeWithOrderNoContext(ctx context.Context, orderNo string) (result *Trade, err error) {
 	return nil, ErrPayPalNotAllowed
 }
 
+func (this *PayPal) Refund(req *RefundRequest) (result *Refund, err error) {
+	return this.RefundContext(context.Background(), req)
+}
+
+// RefundContext 退款，RefundNo 作为 PayPal 退款的 invoice_number。
+// PayPal 的退款接口本身不保证幂等，所以退款之前会检查该交易中是否已经存在 invoice_number 相同的退款，存在时直接返回该退款
+func (this *PayPal) RefundContext(ctx context.Context, req *RefundRequest) (result *Refund, err error) {
+	// PayPal 的退款需要针对 Sale 进行，所以需要先通过 paymentId 获取 Sale 信息
+	if req.TradeNo == "" {
+		return nil, ErrUnknownTradeNo
+	}
+	var payment *paypal.Payment
+	err = call(ctx, func() (err error) {
+		payment, err = this.client.GetPaymentDetails(req.TradeNo)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var sale = saleOfPayment(payment)
+	if sale == nil {
+		return nil, ErrUnknownTradeNo
+	}
+	if refund := refundOfPayment(payment, req.RefundNo); refund != nil {
+		return this.refundWithPayPal(req.OrderNo, refund)
+	}
+
+	// amount 为 nil 时表示全额退款
+	var amount *paypal.Amount
+	if req.Amount.Amount > 0 {
+		amount = &paypal.Amount{}
+		amount.Total = req.Amount.String()
+		amount.Currency = req.Amount.Currency
+		if amount.Currency == "" && sale.Amount != nil {
+			amount.Currency = sale.Amount.Currency
+		}
+	}
+
+	var rsp *paypal.Refund
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.RefundSale(sale.Id, req.RefundNo, amount)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if rsp.InvoiceNumber == "" {
+		rsp.InvoiceNumber = req.RefundNo
+	}
+	return this.refundWithPayPal(req.OrderNo, rsp)
+}
+
+func (this *PayPal) refundWithPayPal(orderNo string, rsp *paypal.Refund) (result *Refund, err error) {
+	result = &Refund{}
+	result.Channel = this.Identifier()
+	result.RawRefund = rsp
+	result.OrderNo = orderNo
+	result.TradeNo = rsp.ParentPayment
+	result.RefundNo = rsp.InvoiceNumber
+	result.RefundId = rsp.Id
+	if rsp.Amount != nil {
+		if result.RefundAmount, err = ParseMoney(rsp.Amount.Total, rsp.Amount.Currency); err != nil {
+			return nil, err
+		}
+	}
+	result.RefundStatus = refundStatusWithPayPal(rsp.State)
+	return result, nil
+}
+
+// refundOfPayment 查找交易中 invoice_number 为 refundNo 的退款
+func refundOfPayment(payment *paypal.Payment, refundNo string) *paypal.Refund {
+	if refundNo == "" {
+		return nil
+	}
+	for _, trans := range payment.Transactions {
+		for _, res := range trans.RelatedResources {
+			if res.Refund != nil && res.Refund.InvoiceNumber == refundNo {
+				return res.Refund
+			}
+		}
+	}
+	return nil
+}
+
+// GetRefund 查询退款信息，refundNo 和其它支付渠道一样为退款编号，即 RefundRequest.RefundNo。
+// PayPal 需要通过渠道交易号查询，所以需要设置 Store；没有设置 Store 或者 Store 中没有该订单时，refundNo 需要为 PayPal 的退款 Id，即 Refund.RefundId
+func (this *PayPal) GetRefund(orderNo, refundNo string) (result *Refund, err error) {
+	return this.GetRefundContext(context.Background(), orderNo, refundNo)
+}
+
+func (this *PayPal) GetRefundContext(ctx context.Context, orderNo, refundNo string) (result *Refund, err error) {
+	payment, err := this.paymentOfOrder(ctx, orderNo)
+	if err != nil && err != ErrStoreNotSet && err != ErrPaymentNotFound && err != ErrUnknownTradeNo {
+		return nil, err
+	}
+	if payment != nil {
+		for _, trans := range payment.Transactions {
+			for _, res := range trans.RelatedResources {
+				if res.Refund != nil && (res.Refund.InvoiceNumber == refundNo || res.Refund.Id == refundNo) {
+					return this.refundWithPayPal(orderNo, res.Refund)
+				}
+			}
+		}
+		return nil, ErrUnknownRefundNo
+	}
+
+	var rsp *paypal.Refund
+	err = call(ctx, func() (err error) {
+		rsp, err = this.client.GetRefundDetails(refundNo)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return this.refundWithPayPal(orderNo, rsp)
+}
+
+// GetRefundsForOrder 查询订单的所有退款，PayPal 需要通过 Store 中保存的渠道交易号查询
+func (this *PayPal) GetRefundsForOrder(orderNo string) (result []*Refund, err error) {
+	return this.GetRefundsForOrderContext(context.Background(), orderNo)
+}
+
+func (this *PayPal) GetRefundsForOrderContext(ctx context.Context, orderNo string) (result []*Refund, err error) {
+	payment, err := this.paymentOfOrder(ctx, orderNo)
+	if err != nil {
+		return nil, err
+	}
+
+	result = make([]*Refund, 0)
+	for _, trans := range payment.Transactions {
+		for _, res := range trans.RelatedResources {
+			if res.Refund == nil {
+				continue
+			}
+			refund, err := this.refundWithPayPal(orderNo, res.Refund)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, refund)
+		}
+	}
+	return result, nil
+}
+
+// paymentOfOrder 通过 Store 中保存的渠道交易号获取订单对应的 Payment
+func (this *PayPal) paymentOfOrder(ctx context.Context, orderNo string) (*paypal.Payment, error) {
+	this.mu.Lock()
+	var store = this.store
+	this.mu.Unlock()
+	if store == nil {
+		return nil, ErrStoreNotSet
+	}
+
+	record, err := store.GetPayment(ctx, this.Identifier(), orderNo)
+	if err != nil {
+		return nil, err
+	}
+	if record.TradeNo == "" {
+		return nil, ErrUnknownTradeNo
+	}
+
+	var payment *paypal.Payment
+	err = call(ctx, func() (err error) {
+		payment, err = this.client.GetPaymentDetails(record.TradeNo)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payment, nil
+}
+
+func saleOfPayment(payment *paypal.Payment) *paypal.Sale {
+	for _, trans := range payment.Transactions {
+		for _, res := range trans.RelatedResources {
+			if res.Sale != nil {
+				return res.Sale
+			}
+		}
+	}
+	return nil
+}
+
+// refundedAmountOfTransaction 统计交易中已完成的退款金额
+func refundedAmountOfTransaction(trans *paypal.Transaction, currency string) (Money, error) {
+	var refunded = NewMoney(0, currency)
+	for _, res := range trans.RelatedResources {
+		if res.Refund == nil || res.Refund.State != paypal.K_REFUND_STATE_COMPLETED || res.Refund.Amount == nil {
+			continue
+		}
+		amount, err := ParseMoney(res.Refund.Amount.Total, res.Refund.Amount.Currency)
+		if err != nil {
+			return refunded, err
+		}
+		refunded = refunded.Add(amount)
+	}
+	return refunded, nil
+}
+
+func refundStatusWithPayPal(state paypal.RefundState) string {
+	switch state {
+	case paypal.K_REFUND_STATE_COMPLETED:
+		return K_REFUND_STATUS_SUCCESS
+	case paypal.K_REFUND_STATE_CANCELLED, paypal.K_REFUND_STATE_FAILED:
+		return K_REFUND_STATUS_FAILED
+	}
+	return K_REFUND_STATUS_PROCESSING
+}
+
+// CloseTrade 关闭交易。
+// PayPal 不提供取消 Payment 的接口，未执行（execute）的 Payment 会在 3 小时之后自动过期，
+// 所以这里只记录该订单已经关闭，之后不会再执行该订单对应的 Payment，用户即使已经授权付款也不会扣款。
+// 关闭记录在当前进程中只保留 3 小时，设置了 Store 时以 Store 中的订单状态为准，可以在多个进程之间共享。
+func (this *PayPal) CloseTrade(orderNo string) (err error) {
+	return this.CloseTradeContext(context.Background(), orderNo)
+}
+
+func (this *PayPal) CloseTradeContext(ctx context.Context, orderNo string) (err error) {
+	var now = time.Now()
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// Payment 过期之后不会再被执行，不需要再保留关闭记录
+	for key, closedAt := range this.closedOrders {
+		if now.Sub(closedAt) > k_PAYPAL_PAYMENT_EXPIRES {
+			delete(this.closedOrders, key)
+		}
+	}
+	this.closedOrders[orderNo] = now
+	return nil
+}
+
+// isClosed 检查 Payment 对应的订单是否已经关闭，设置了 Store 时同时检查订单在 Store 中的状态
+func (this *PayPal) isClosed(ctx context.Context, payment *paypal.Payment) (bool, error) {
+	if len(payment.Transactions) == 0 {
+		return false, nil
+	}
+	var orderNo = payment.Transactions[0].InvoiceNumber
+
+	this.mu.Lock()
+	var _, ok = this.closedOrders[orderNo]
+	var store = this.store
+	this.mu.Unlock()
+	if ok || store == nil || orderNo == "" {
+		return ok, nil
+	}
+
+	record, err := store.GetPayment(ctx, this.Identifier(), orderNo)
+	if err == ErrPaymentNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// 已经过期的订单即将被 ExpiryScheduler 关闭，也不再执行
+	return record.Status == K_ORDER_STATE_CLOSED || record.Status == K_ORDER_STATE_EXPIRED, nil
+}
+
+const (
+	k_PAYPAL_API_URL         = "https://api.paypal.com"
+	k_PAYPAL_SANDBOX_API_URL = "https://api.sandbox.paypal.com"
+
+	k_PAYPAL_TRANSACTION_PAGE_SIZE      = 500
+	k_PAYPAL_TRANSACTION_STATUS_SUCCESS = "S"
+	k_PAYPAL_TRANSACTION_EVENT_REFUND   = "T1107"
+	k_PAYPAL_TRANSACTION_TIME_LAYOUT    = "2006-01-02T15:04:05-0700"
+)
+
+type paypalAccessToken struct {
+	AccessToken string `json:"access_token"`
+}
+
+type paypalMoney struct {
+	CurrencyCode string `json:"currency_code"`
+	Value        string `json:"value"`
+}
+
+type paypalTransactionInfo struct {
+	TransactionId             string       `json:"transaction_id"`
+	PayPalReferenceId         string       `json:"paypal_reference_id"`
+	TransactionEventCode      string       `json:"transaction_event_code"`
+	TransactionInitiationDate string       `json:"transaction_initiation_date"`
+	TransactionUpdatedDate    string       `json:"transaction_updated_date"`
+	TransactionAmount         *paypalMoney `json:"transaction_amount"`
+	FeeAmount                 *paypalMoney `json:"fee_amount"`
+	TransactionStatus         string       `json:"transaction_status"`
+	InvoiceId                 string       `json:"invoice_id"`
+}
+
+type paypalTransactionDetail struct {
+	TransactionInfo *paypalTransactionInfo `json:"transaction_info"`
+}
+
+type paypalTransactionSearch struct {
+	TransactionDetails []*paypalTransactionDetail `json:"transaction_details"`
+	Page               int                        `json:"page"`
+	TotalPages         int                        `json:"total_pages"`
+}
+
+type paypalAPIError struct {
+	Name             string `json:"name"`
+	Message          string `json:"message"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (this *PayPal) DownloadBill(date time.Time) (result *Bill, err error) {
+	return this.DownloadBillContext(context.Background(), date)
+}
+
+// DownloadBillContext 通过交易查询（Transaction Search）接口获取指定日期（UTC）内已完成的交易及退款，
+// SDK 没有提供该接口，需要自行获取 Access Token 并发送请求。PayPal 的交易数据最多可能会有 3 个小时的延迟。
+// BillRecord 的 TradeNo 为 Sale 的 Id，而不是 Trade.TradeNo 使用的 Payment Id
+func (this *PayPal) DownloadBillContext(ctx context.Context, date time.Time) (result *Bill, err error) {
+	result = &Bill{}
+	result.Channel = this.Identifier()
+	result.Start, result.End = billDay(date, time.UTC)
+
+	token, err := this.accessToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for page, totalPages := 1, 1; page <= totalPages; page++ {
+		var values = url.Values{}
+		values.Set("start_date", result.Start.Format(time.RFC3339))
+		values.Set("end_date", result.End.Add(-time.Second).Format(time.RFC3339))
+		values.Set("transaction_status", k_PAYPAL_TRANSACTION_STATUS_SUCCESS)
+		values.Set("fields", "transaction_info")
+		values.Set("page_size", strconv.Itoa(k_PAYPAL_TRANSACTION_PAGE_SIZE))
+		values.Set("page", strconv.Itoa(page))
+
+		req, err := http.NewRequest(http.MethodGet, this.apiURL()+"/v1/reporting/transactions?"+values.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+
+		var rsp = &paypalTransactionSearch{}
+		if err = this.doRequest(ctx, req, rsp); err != nil {
+			return nil, err
+		}
+		totalPages = rsp.TotalPages
+
+		for _, detail := range rsp.TransactionDetails {
+			record, err := this.billRecordWithTransaction(detail)
+			if err != nil {
+				return nil, err
+			}
+			if record != nil {
+				result.Records = append(result.Records, record)
+			}
+		}
+	}
+	return result, nil
+}
+
+// billRecordWithTransaction 只保留收款及退款记录，其它类型的交易（例如提现、争议）返回 nil
+func (this *PayPal) billRecordWithTransaction(detail *paypalTransactionDetail) (*BillRecord, error) {
+	var info = detail.TransactionInfo
+	if info == nil || info.TransactionAmount == nil {
+		return nil, nil
+	}
+
+	var record = &BillRecord{}
+	record.Channel = this.Identifier()
+	record.OrderNo = info.InvoiceId
+	record.TradeNo = info.TransactionId
+	record.Time = parseTime(k_PAYPAL_TRANSACTION_TIME_LAYOUT, info.TransactionInitiationDate, time.UTC)
+	record.RawRecord = detail
+
+	switch {
+	case info.TransactionEventCode == k_PAYPAL_TRANSACTION_EVENT_REFUND:
+		record.Type = K_BILL_TYPE_REFUND
+		record.TradeNo = info.PayPalReferenceId
+		record.RefundNo = info.TransactionId
+	case strings.HasPrefix(info.TransactionEventCode, "T00"):
+		// T00 开头的事件为各种类型的收款
+		record.Type = K_BILL_TYPE_TRADE
+	default:
+		return nil, nil
+	}
+
+	var err error
+	if record.Amount, err = parseBillMoney(info.TransactionAmount.Value, info.TransactionAmount.CurrencyCode); err != nil {
+		return nil, err
+	}
+	record.Fee = NewMoney(0, record.Amount.Currency)
+	if info.FeeAmount != nil {
+		if record.Fee, err = parseBillMoney(info.FeeAmount.Value, info.FeeAmount.CurrencyCode); err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+func (this *PayPal) apiURL() string {
+	if this.isProduction {
+		return k_PAYPAL_API_URL
+	}
+	return k_PAYPAL_SANDBOX_API_URL
+}
+
+// accessToken 使用 client id 和 secret 获取 Access Token
+func (this *PayPal) accessToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, this.apiURL()+"/v1/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	if err != nil {
+		return "", err
+	}
+	req.SetBasicAuth(this.clientId, this.secret)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var token = &paypalAccessToken{}
+	if err = this.doRequest(ctx, req, token); err != nil {
+		return "", err
+	}
+	return token.AccessToken, nil
+}
+
+func (this *PayPal) doRequest(ctx context.Context, req *http.Request, result interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	rsp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return err
+	}
+	if rsp.StatusCode != http.StatusOK {
+		var apiErr = &paypalAPIError{}
+		json.Unmarshal(data, apiErr)
+		if apiErr.Message != "" {
+			return errors.New(apiErr.Message)
+		}
+		if apiErr.ErrorDescription != "" {
+			return errors.New(apiErr.ErrorDescription)
+		}
+		return fmt.Errorf("PayPal 请求失败: %s", rsp.Status)
+	}
+	return json.Unmarshal(data, result)
+}
+
 func (this *PayPal) ReturnRequestHandler(req *http.Request) (result *Trade, err error) {
 	var tradeNo = req.FormValue("paymentId")
 	if tradeNo == "" {
 		return nil, ErrUnknownTradeNo
 	}
-	trade, err := this.GetTrade(tradeNo)
+	trade, err := this.GetTradeContext(req.Context(), tradeNo)
 	if err != nil {
 		return nil, err
 	}
@@ -168,28 +736,89 @@ func (this *PayPal) ReturnRequestHandler(req *http.Request) (result *Trade, err
 }
 
 func (this *PayPal) NotifyRequestHandler(req *http.Request) (result *Notification, err error) {
-	event, err := this.client.GetWebhookEvent(this.WebHookId, req)
+	// ctx 被取消之后 GetWebhookEvent 仍会在其它 goroutine 中执行，所以使用 req 的副本，避免在返回之后访问 req
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return nil, err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var r = req.Clone(context.Background())
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var event *paypal.Event
+	err = call(req.Context(), func() (err error) {
+		event, err = this.client.GetWebhookEvent(this.WebHookId, r)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	result = &Notification{}
 	result.Channel = this.Identifier()
+	result.NotifyId = event.Id
 	result.RawNotify = event
 
-	// TODO 需要处理退款
 	switch event.ResourceType {
 	case paypal.K_EVENT_RESOURCE_TYPE_SALE:
+		var sale = event.Sale()
 		result.NotifyType = K_NOTIFY_TYPE_TRADE
-		result.OrderNo = event.Sale().InvoiceNumber
-		result.TradeNo = event.Sale().ParentPayment
+		result.OrderNo = sale.InvoiceNumber
+		result.TradeNo = sale.ParentPayment
+		result.TradeStatus = string(sale.State)
+		result.Status = saleStatusWithPayPal(sale.State)
+		if sale.Amount != nil {
+			if result.Amount, err = ParseMoney(sale.Amount.Total, sale.Amount.Currency); err != nil {
+				return nil, err
+			}
+		}
 	case paypal.K_EVENT_RESOURCE_TYPE_REFUND:
+		// 退款的 invoice_number 为退款编号，订单号需要通过退款对应的 Payment 获取
+		var refund = event.Refund()
 		result.NotifyType = K_NOTIFY_TYPE_REFUND
-		result.OrderNo = event.Refund().InvoiceNumber
-		result.TradeNo = event.Refund().ParentPayment
+		result.TradeNo = refund.ParentPayment
+		result.RefundNo = refund.InvoiceNumber
+		result.RefundId = refund.Id
+		if result.OrderNo, err = this.orderNoOfPayment(req.Context(), refund.ParentPayment); err != nil {
+			return nil, err
+		}
+		result.RefundStatus = refundStatusWithPayPal(refund.State)
+		if amount := refund.Amount; amount != nil {
+			if result.RefundAmount, err = ParseMoney(amount.Total, amount.Currency); err != nil {
+				return nil, err
+			}
+		}
 	case paypal.K_EVENT_RESOURCE_TYPE_DISPUTE:
 		result.NotifyType = K_NOTIFY_TYPE_DISPUTE
 		result.OrderNo = event.Dispute().DisputedTransactions[0].InvoiceNumber
 	}
 	return result, nil
 }
+
+func (this *PayPal) orderNoOfPayment(ctx context.Context, tradeNo string) (string, error) {
+	if tradeNo == "" {
+		return "", nil
+	}
+	var payment *paypal.Payment
+	err := call(ctx, func() (err error) {
+		payment, err = this.client.GetPaymentDetails(tradeNo)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(payment.Transactions) == 0 {
+		return "", nil
+	}
+	return payment.Transactions[0].InvoiceNumber, nil
+}
+
+// WriteNotifyResponse PayPal 需要返回 2xx 状态码，否则会重新发送通知
+func (this *PayPal) WriteNotifyResponse(w http.ResponseWriter, err error) {
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
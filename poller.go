@@ -0,0 +1,210 @@
+package pay4go
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	k_POLLER_INTERVAL     = 10 * time.Second
+	k_POLLER_MIN_BACKOFF  = 10 * time.Second
+	k_POLLER_MAX_BACKOFF  = 10 * time.Minute
+	k_POLLER_MAX_AGE      = 24 * time.Hour
+	k_POLLER_BATCH_SIZE   = 100
+	k_POLLER_BACKOFF_RATE = 2
+)
+
+// TradePoller 定期查询 Store 中最近创建、仍在等待支付的订单，作为没有收到通知时的补充。
+// 查询到的交易信息和通知一样会校验金额、更新订单状态并分发 TradePaid、TradeClosed 等事件。
+// 同一订单的查询间隔从 MinBackoff 开始按倍数增加，直到 MaxBackoff。
+type TradePoller struct {
+	Interval   time.Duration                          // 检查的时间间隔，默认为 10 秒
+	MinBackoff time.Duration                          // 同一订单第一次查询的间隔，默认为 10 秒
+	MaxBackoff time.Duration                          // 同一订单最大的查询间隔，默认为 10 分钟
+	MaxAge     time.Duration                          // 只查询该时间之内创建的订单，默认为 24 小时
+	BatchSize  int                                    // 每次最多查询的订单数量（不包括处于退避中的订单），默认为 100
+	OnError    func(record *PaymentRecord, err error) // 查询订单出错时调用
+
+	service *Service
+	mu      sync.Mutex
+	backoff map[string]*pollState
+}
+
+type pollState struct {
+	attempts int
+	next     time.Time
+}
+
+func NewTradePoller(service *Service) *TradePoller {
+	var p = &TradePoller{}
+	p.service = service
+	p.Interval = k_POLLER_INTERVAL
+	p.MinBackoff = k_POLLER_MIN_BACKOFF
+	p.MaxBackoff = k_POLLER_MAX_BACKOFF
+	p.MaxAge = k_POLLER_MAX_AGE
+	p.BatchSize = k_POLLER_BATCH_SIZE
+	p.backoff = make(map[string]*pollState)
+	return p
+}
+
+// Run 定期查询等待支付的订单，直到 ctx 被取消
+func (this *TradePoller) Run(ctx context.Context) error {
+	if this.service.getStore() == nil {
+		return ErrStoreNotSet
+	}
+
+	var interval = this.Interval
+	if interval <= 0 {
+		interval = k_POLLER_INTERVAL
+	}
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := this.RunOnce(ctx); err != nil && ctx.Err() == nil && this.OnError != nil {
+			this.OnError(nil, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunOnce 查询一次到达查询时间的订单
+func (this *TradePoller) RunOnce(ctx context.Context) error {
+	var store = this.service.getStore()
+	if store == nil {
+		return ErrStoreNotSet
+	}
+
+	var now = time.Now()
+	var query = &PaymentQuery{}
+	query.Statuses = []string{K_ORDER_STATE_PENDING}
+	query.CreatedAfter = now.Add(-this.maxAge())
+
+	var batchSize = this.BatchSize
+	if batchSize <= 0 {
+		batchSize = k_POLLER_BATCH_SIZE
+	}
+
+	// 处于退避中的订单不占用 batchSize，所以需要遍历全部等待支付的订单
+	records, err := findAllPayments(ctx, store, query)
+	if err != nil {
+		return err
+	}
+
+	var pending = make(map[string]struct{}, len(records))
+	var polled = 0
+	for _, record := range records {
+		var key = paymentKey(record.Channel, record.OrderNo)
+		pending[key] = struct{}{}
+		if polled >= batchSize || !this.due(key, now) {
+			continue
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		polled++
+		if err = this.poll(ctx, record); err != nil && this.OnError != nil {
+			this.OnError(record, err)
+		}
+	}
+	this.prune(pending)
+	return nil
+}
+
+func (this *TradePoller) poll(ctx context.Context, record *PaymentRecord) error {
+	var p = this.service.getChannel(record.Channel)
+	if p == nil {
+		return ErrUnknownChannel
+	}
+
+	var trade *Trade
+	var err error
+	if p.Capability().SupportFeature(K_FEATURE_QUERY_BY_ORDER_NO) {
+		trade, err = p.GetTradeWithOrderNoContext(ctx, record.OrderNo)
+	} else if record.TradeNo != "" {
+		trade, err = p.GetTradeContext(ctx, record.TradeNo)
+	} else {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if state := orderStateWithTradeStatus(trade.Status); state == "" || state == K_ORDER_STATE_PENDING {
+		return nil
+	}
+	return this.service.processNotification(ctx, p, notificationWithTrade(trade))
+}
+
+// due 判断订单是否到达查询时间，到达时计算下一次的查询时间
+func (this *TradePoller) due(key string, now time.Time) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var s = this.backoff[key]
+	if s == nil {
+		s = &pollState{}
+		this.backoff[key] = s
+	}
+	if now.Before(s.next) {
+		return false
+	}
+
+	var backoff = this.MinBackoff
+	if backoff <= 0 {
+		backoff = k_POLLER_MIN_BACKOFF
+	}
+	var maxBackoff = this.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = k_POLLER_MAX_BACKOFF
+	}
+	for i := 0; i < s.attempts && backoff < maxBackoff; i++ {
+		backoff *= k_POLLER_BACKOFF_RATE
+	}
+	if backoff > maxBackoff {
+		backoff = maxBackoff
+	}
+	s.attempts++
+	s.next = now.Add(backoff)
+	return true
+}
+
+// prune 清除已经不再等待支付的订单的查询记录
+func (this *TradePoller) prune(pending map[string]struct{}) {
+	this.mu.Lock()
+	for key := range this.backoff {
+		if _, ok := pending[key]; !ok {
+			delete(this.backoff, key)
+		}
+	}
+	this.mu.Unlock()
+}
+
+func (this *TradePoller) maxAge() time.Duration {
+	if this.MaxAge <= 0 {
+		return k_POLLER_MAX_AGE
+	}
+	return this.MaxAge
+}
+
+// notificationWithTrade 将主动查询到的交易信息转换为交易通知
+func notificationWithTrade(trade *Trade) *Notification {
+	var noti = &Notification{}
+	noti.Channel = trade.Channel
+	noti.NotifyType = K_NOTIFY_TYPE_TRADE
+	noti.OrderNo = trade.OrderNo
+	noti.TradeNo = trade.TradeNo
+	noti.Status = trade.Status
+	noti.TradeStatus = trade.TradeStatus
+	noti.Amount = trade.TotalAmount
+	noti.PayerId = trade.PayerId
+	noti.PayerEmail = trade.PayerEmail
+	noti.Trade = trade
+	noti.RawNotify = trade.RawTrade
+	return noti
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/smartwalle/pay4go"
@@ -72,18 +73,24 @@ func main() {
 	ps.RegisterChannel(pp)
 	ps.RegisterChannel(wp)
 
-	http.HandleFunc("/pay/notify", func(w http.ResponseWriter, req *http.Request) {
-		fmt.Println("notification", req.FormValue("channel"), req.FormValue("order_no"))
-
-		var noti, err = ps.NotifyRequestHandler(req)
-		if err != nil {
-			fmt.Println(err)
-			return
+	ps.OnTradePaid(func(ctx context.Context, event *pay4go.Event) error {
+		// 由通知触发时，没有开启 AttachTrade 的情况下 event.Trade 为空
+		var amount pay4go.Money
+		if event.Trade != nil {
+			amount = event.Trade.TotalAmount
+		} else if event.Notification != nil {
+			amount = event.Notification.Amount
 		}
-		bs, _ := json.Marshal(noti)
-		fmt.Println(string(bs))
+		fmt.Println("paid", event.Channel, event.OrderNo, amount)
+		return nil
 	})
 
+	http.Handle("/pay/notify", ps.NotifyHandler(func(ctx context.Context, noti *pay4go.Notification) error {
+		bs, _ := json.Marshal(noti)
+		fmt.Println("notification", string(bs))
+		return nil
+	}))
+
 	http.HandleFunc("/pay/cancel", func(w http.ResponseWriter, req *http.Request) {
 		fmt.Println("cancel", req.FormValue("channel"), req.FormValue("order_no"))
 	})
@@ -108,22 +115,31 @@ func main() {
 		var p = &pay4go.Order{}
 		p.TradeMethod = method
 		p.OrderNo = xid.NewXID().Hex()
-		p.Currency = "USD"
-		p.Discount = 10.33
+		// 支付宝及微信支付只支持人民币
+		p.Currency = pay4go.K_CURRENCY_CNY
+		if channel == pay4go.K_CHANNEL_PAYPAL {
+			p.Currency = pay4go.K_CURRENCY_USD
+		}
+		p.Discount = pay4go.MustParseMoney("10.33", p.Currency)
 		for i := 0; i < 3; i++ {
-			p.AddProduct("test", "sku001", 1, 14.99, 0)
+			p.AddProduct("test", "sku001", 1, pay4go.MustParseMoney("14.99", p.Currency), pay4go.NewMoney(0, p.Currency))
 		}
 		p.Timeout = 3
 
-		var url, err = ps.CreatePayment(channel, p)
+		var result, err = ps.CreatePayment(channel, p)
 
 		if err != nil {
 			w.Write([]byte(err.Error()))
 			return
 		}
 
-		fmt.Println(channel, method, url)
-		http.Redirect(w, req, url, http.StatusTemporaryRedirect)
+		fmt.Println(channel, method, result.Kind, result.Payload)
+		if result.Kind == pay4go.K_PAYMENT_KIND_REDIRECT {
+			http.Redirect(w, req, result.Payload, http.StatusTemporaryRedirect)
+			return
+		}
+		resultByte, _ := json.Marshal(result)
+		w.Write(resultByte)
 	})
 	http.ListenAndServe(":5000", nil)
 }
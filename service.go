@@ -1,71 +1,376 @@
 package pay4go
 
 import (
+	"context"
 	"net/http"
+	"sync"
 )
 
+// Service 可以在多个 goroutine 中同时使用
 type Service struct {
-	channels map[string]PayChannel
+	mu          sync.RWMutex
+	channels    map[string]PayChannel
+	handlers    map[string][]EventHandler
+	attachTrade bool
+	lookup      AmountLookup
+	store       Store
+	notifyStore NotifyStore
 }
 
 func NewService() *Service {
 	var s = &Service{}
 	s.channels = make(map[string]PayChannel)
+	s.handlers = make(map[string][]EventHandler)
 	return s
 }
 
+// RegisterChannel 注册支付渠道，如果已经存在相同标识的支付渠道，则会替换该支付渠道。
+// 正在使用旧支付渠道处理的请求不受影响，之后的请求将使用新的支付渠道。
 func (this *Service) RegisterChannel(c PayChannel) {
 	if c != nil {
+		this.mu.Lock()
 		this.channels[c.Identifier()] = c
+		if s, ok := c.(storeSetter); ok && this.store != nil {
+			s.SetStore(this.store)
+		}
+		this.mu.Unlock()
 	}
 }
 
 func (this *Service) RemoveChannel(channel string) {
+	this.mu.Lock()
 	delete(this.channels, channel)
+	this.mu.Unlock()
 }
 
-func (this *Service) CreatePayment(channel string, order *Order) (url string, err error) {
-	var p = this.channels[channel]
+// AttachTrade 设置收到交易通知之后是否重新查询交易信息，查询结果保存在 Notification.Trade 中，
+// 开启之后以查询到的交易状态为准
+func (this *Service) AttachTrade(attach bool) {
+	this.mu.Lock()
+	this.attachTrade = attach
+	this.mu.Unlock()
+}
+
+func (this *Service) getChannel(channel string) PayChannel {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.channels[channel]
+}
+
+func (this *Service) CreatePayment(channel string, order *Order) (result *PaymentIntent, err error) {
+	return this.CreatePaymentContext(context.Background(), channel, order)
+}
+
+func (this *Service) CreatePaymentContext(ctx context.Context, channel string, order *Order) (result *PaymentIntent, err error) {
+	var p = this.getChannel(channel)
 	if p == nil {
-		return "", ErrUnknownChannel
+		return nil, ErrUnknownChannel
+	}
+	if err = p.Capability().validateOrder(channel, order); err != nil {
+		return nil, err
+	}
+
+	var store = this.getStore()
+	if store != nil {
+		var record = &PaymentRecord{}
+		record.Channel = channel
+		record.OrderNo = order.OrderNo
+		record.Status = K_ORDER_STATE_CREATED
+		record.Amount = order.TotalAmount()
+		record.ExpiresAt = expiresAt(order.Timeout)
+		if err = store.AddPayment(ctx, record); err == ErrPaymentExists {
+			// 重新为已经存在的订单发起支付，只有还没有支付并且金额相同的订单可以继续，订单状态由状态机变更
+			current, err := store.GetPayment(ctx, channel, order.OrderNo)
+			if err != nil {
+				return nil, err
+			}
+			if current.Status != K_ORDER_STATE_CREATED && current.Status != K_ORDER_STATE_PENDING {
+				return nil, &StateTransitionError{Channel: channel, OrderNo: order.OrderNo, From: current.Status, To: K_ORDER_STATE_PENDING}
+			}
+			if current.Amount != record.Amount {
+				return nil, ErrAmountMismatch
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	if result, err = p.CreateTradeOrderContext(ctx, order); err != nil {
+		return nil, err
 	}
-	return p.CreateTradeOrder(order)
+
+	// 渠道订单已经创建，更新订单状态失败时仍然返回支付信息，之后的通知或者查询交易会再次更新订单状态
+	if store != nil {
+		var record = &PaymentRecord{}
+		record.Channel = channel
+		record.OrderNo = order.OrderNo
+		record.TradeNo = result.TradeNo
+		record.ExpiresAt = result.ExpiresAt
+		record.Status = K_ORDER_STATE_PENDING
+		if result.Kind == K_PAYMENT_KIND_COMPLETED {
+			record.Status = K_ORDER_STATE_PAID
+		}
+		this.transit(ctx, record)
+	}
+
+	// 付款码支付等同步完成的支付，支付成功事件处理失败时同时返回支付信息及错误
+	if result.Kind == K_PAYMENT_KIND_COMPLETED {
+		var event = &Event{}
+		event.Type = K_EVENT_TYPE_TRADE_PAID
+		event.Channel = channel
+		event.OrderNo = order.OrderNo
+		event.TradeNo = result.TradeNo
+		if err = this.emitTradePaid(ctx, event); err != nil && err != ErrNotifyProcessing {
+			return result, err
+		}
+	}
+	return result, nil
 }
 
 func (this *Service) GetTrade(channel string, tradeNo string) (result *Trade, err error) {
-	var p = this.channels[channel]
+	return this.GetTradeContext(context.Background(), channel, tradeNo)
+}
+
+func (this *Service) GetTradeContext(ctx context.Context, channel string, tradeNo string) (result *Trade, err error) {
+	var p = this.getChannel(channel)
 	if p == nil {
 		return nil, ErrUnknownChannel
 	}
-	return p.GetTrade(tradeNo)
+	if result, err = p.GetTradeContext(ctx, tradeNo); err != nil {
+		return nil, err
+	}
+	if err = this.recordTrade(ctx, result); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 func (this *Service) GetTradeWithOrderNo(channel string, orderNo string) (result *Trade, err error) {
-	var p = this.channels[channel]
+	return this.GetTradeWithOrderNoContext(context.Background(), channel, orderNo)
+}
+
+func (this *Service) GetTradeWithOrderNoContext(ctx context.Context, channel string, orderNo string) (result *Trade, err error) {
+	var p = this.getChannel(channel)
 	if p == nil {
 		return nil, ErrUnknownChannel
 	}
-	return p.GetTradeWithOrderNo(orderNo)
+	if err = p.Capability().validateFeature(channel, K_FEATURE_QUERY_BY_ORDER_NO); err != nil {
+		return nil, err
+	}
+	if result, err = p.GetTradeWithOrderNoContext(ctx, orderNo); err != nil {
+		return nil, err
+	}
+	if err = this.recordTrade(ctx, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (this *Service) Refund(channel string, req *RefundRequest) (result *Refund, err error) {
+	return this.RefundContext(context.Background(), channel, req)
+}
+
+func (this *Service) RefundContext(ctx context.Context, channel string, req *RefundRequest) (result *Refund, err error) {
+	var p = this.getChannel(channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	if err = p.Capability().validateFeature(channel, K_FEATURE_REFUND); err != nil {
+		return nil, err
+	}
+	if result, err = p.RefundContext(ctx, req); err != nil {
+		return nil, err
+	}
+
+	// 退款结果需要等待通知的（微信支付）由通知变更订单状态。
+	// 退款已经成功，更新订单状态失败时仍然返回退款结果，之后的退款通知或者查询交易会再次更新订单状态
+	if result.RefundStatus == K_REFUND_STATUS_SUCCESS {
+		this.recordRefund(ctx, channel, req, result)
+	}
+	return result, nil
+}
+
+// recordRefund 累计同步返回成功的退款金额并变更订单状态，退款金额为 0 时为全额退款
+func (this *Service) recordRefund(ctx context.Context, channel string, req *RefundRequest, refund *Refund) error {
+	var record = &PaymentRecord{}
+	record.Channel = channel
+	record.OrderNo = refund.OrderNo
+	if record.OrderNo == "" {
+		record.OrderNo = req.OrderNo
+	}
+
+	var refundKey = refund.RefundId
+	if refundKey == "" {
+		refundKey = req.RefundNo
+	}
+	var amount = req.Amount
+	if amount.IsZero() {
+		amount = refund.RefundAmount
+	}
+
+	status, err := this.refundState(ctx, channel, record.OrderNo, refundKey, amount, Money{})
+	if err != nil {
+		return err
+	}
+	record.Status = K_ORDER_STATE_REFUNDED
+	if !req.Amount.IsZero() {
+		record.Status = status
+	}
+	return this.transit(ctx, record)
+}
+
+// GetRefund 查询退款信息，refundNo 为退款编号，即 RefundRequest.RefundNo，所有支付渠道相同
+func (this *Service) GetRefund(channel string, orderNo, refundNo string) (result *Refund, err error) {
+	return this.GetRefundContext(context.Background(), channel, orderNo, refundNo)
+}
+
+func (this *Service) GetRefundContext(ctx context.Context, channel string, orderNo, refundNo string) (result *Refund, err error) {
+	var p = this.getChannel(channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	if err = p.Capability().validateFeature(channel, K_FEATURE_REFUND_QUERY); err != nil {
+		return nil, err
+	}
+	return p.GetRefundContext(ctx, orderNo, refundNo)
+}
+
+// GetRefundsForOrder 查询订单的全部退款，支付宝及 PayPal 需要设置 Store，支付宝只能查询到通过 Service 发起的退款
+func (this *Service) GetRefundsForOrder(channel string, orderNo string) (result []*Refund, err error) {
+	return this.GetRefundsForOrderContext(context.Background(), channel, orderNo)
+}
+
+func (this *Service) GetRefundsForOrderContext(ctx context.Context, channel string, orderNo string) (result []*Refund, err error) {
+	var p = this.getChannel(channel)
+	if p == nil {
+		return nil, ErrUnknownChannel
+	}
+	if err = p.Capability().validateFeature(channel, K_FEATURE_REFUND_LIST); err != nil {
+		return nil, err
+	}
+	return p.GetRefundsForOrderContext(ctx, orderNo)
+}
+
+func (this *Service) CloseTrade(channel string, orderNo string) (err error) {
+	return this.CloseTradeContext(context.Background(), channel, orderNo)
+}
+
+func (this *Service) CloseTradeContext(ctx context.Context, channel string, orderNo string) (err error) {
+	var p = this.getChannel(channel)
+	if p == nil {
+		return ErrUnknownChannel
+	}
+	if err = p.Capability().validateFeature(channel, K_FEATURE_CLOSE_TRADE); err != nil {
+		return err
+	}
+	if err = p.CloseTradeContext(ctx, orderNo); err != nil {
+		return err
+	}
+	if err = this.transit(ctx, &PaymentRecord{Channel: channel, OrderNo: orderNo, Status: K_ORDER_STATE_CLOSED}); err != nil {
+		return err
+	}
+	return this.emit(ctx, &Event{Type: K_EVENT_TYPE_TRADE_CLOSED, Channel: channel, OrderNo: orderNo})
 }
 
 func (this *Service) ReturnRequestHandler(req *http.Request) (result *Trade, err error) {
 	req.ParseForm()
 
 	var channel = req.FormValue("channel")
-	var p = this.channels[channel]
+	var p = this.getChannel(channel)
 	if p == nil {
 		return nil, ErrUnknownChannel
 	}
-	return p.ReturnRequestHandler(req)
+	if result, err = p.ReturnRequestHandler(req); err != nil {
+		return nil, err
+	}
+	if err = this.verifyAmount(req.Context(), channel, result.OrderNo, result.TotalAmount); err != nil {
+		return nil, err
+	}
+	if err = this.recordTrade(req.Context(), result); err != nil {
+		return nil, err
+	}
+	if result.TradeSuccess {
+		// 支付成功事件正在由通知处理时不需要等待
+		if err = this.emitTradePaid(req.Context(), newTradeEvent(K_EVENT_TYPE_TRADE_PAID, result)); err != nil && err != ErrNotifyProcessing {
+			return nil, err
+		}
+	}
+	return result, nil
 }
 
+// NotifyRequestHandler 验证并处理通知，开启了通知去重时，重复的通知不会再分发事件，其 Duplicate 为 true
 func (this *Service) NotifyRequestHandler(req *http.Request) (result *Notification, err error) {
+	return this.handleNotification(req, nil)
+}
+
+// handleNotification fn 不为 nil 时会在事件分发之后调用，开启了通知去重时，只有 fn 也处理成功才会将通知标记为已处理
+func (this *Service) handleNotification(req *http.Request, fn NotifyHandlerFunc) (result *Notification, err error) {
 	req.ParseForm()
 
 	var channel = req.FormValue("channel")
-	var p = this.channels[channel]
+	var p = this.getChannel(channel)
 	if p == nil {
 		return nil, ErrUnknownChannel
 	}
-	return p.NotifyRequestHandler(req)
+	if result, err = p.NotifyRequestHandler(req); err != nil {
+		return nil, err
+	}
+
+	var ctx = req.Context()
+	var notifyStore = this.getNotifyStore()
+	var key = notifyKey(result)
+	if notifyStore != nil && key != "" {
+		var ok bool
+		if ok, err = notifyStore.Reserve(ctx, key); err != nil {
+			return nil, err
+		}
+		if !ok {
+			result.Duplicate = true
+			return result, nil
+		}
+		defer func() {
+			if err != nil {
+				// 请求可能已经被取消，使用新的 Context 确保能够取消标记
+				notifyStore.Release(context.Background(), key)
+				return
+			}
+			if err = notifyStore.Confirm(ctx, key); err != nil {
+				result = nil
+			}
+		}()
+	}
+
+	if err = this.processNotification(ctx, p, result); err != nil {
+		return nil, err
+	}
+	if fn != nil {
+		if err = fn(ctx, result); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// processNotification 校验金额、更新订单状态并分发事件，通知已经附带交易信息时不会重新查询
+func (this *Service) processNotification(ctx context.Context, p PayChannel, noti *Notification) (err error) {
+	this.mu.RLock()
+	var attachTrade = this.attachTrade
+	this.mu.RUnlock()
+	if attachTrade && noti.NotifyType == K_NOTIFY_TYPE_TRADE && noti.Trade == nil {
+		if noti.Trade, err = this.queryTrade(ctx, p, noti.TradeNo, noti.OrderNo); err != nil {
+			return err
+		}
+	}
+
+	var amount = noti.Amount
+	if noti.Trade != nil {
+		amount = noti.Trade.TotalAmount
+	}
+	if err = this.verifyAmount(ctx, noti.Channel, noti.OrderNo, amount); err != nil {
+		return err
+	}
+	if err = this.recordNotification(ctx, noti); err != nil {
+		return err
+	}
+	return this.dispatchNotification(ctx, noti)
 }
@@ -0,0 +1,325 @@
+package pay4go
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	k_SQL_STORE_TABLE = "pay4go_payment"
+)
+
+// SQLStore 使用 database/sql 保存订单信息、退款记录及通知的处理状态，同时实现了 Store 和 NotifyStore，
+// SQL 语句使用 ? 作为占位符，适用于 SQLite 及 MySQL，时间以 Unix 时间戳（秒）保存
+type SQLStore struct {
+	db    *sql.DB
+	table string
+}
+
+// NewSQLStore table 为保存订单信息的表名，为空时使用 pay4go_payment，退款记录及通知的处理状态分别保存在 table_refund 和 table_notify 表中
+func NewSQLStore(db *sql.DB, table string) *SQLStore {
+	if table == "" {
+		table = k_SQL_STORE_TABLE
+	}
+	var s = &SQLStore{}
+	s.db = db
+	s.table = table
+	return s
+}
+
+// CreateTable 创建保存订单信息、退款记录及通知处理状态的表，表已经存在时不做任何处理
+func (this *SQLStore) CreateTable(ctx context.Context) error {
+	var query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	channel         VARCHAR(32) NOT NULL,
+	order_no        VARCHAR(64) NOT NULL,
+	trade_no        VARCHAR(64) NOT NULL DEFAULT '',
+	status          VARCHAR(32) NOT NULL DEFAULT '',
+	amount          BIGINT      NOT NULL DEFAULT 0,
+	currency        VARCHAR(8)  NOT NULL DEFAULT '',
+	refunded_amount BIGINT      NOT NULL DEFAULT 0,
+	expires_at      BIGINT      NOT NULL DEFAULT 0,
+	created_at      BIGINT      NOT NULL DEFAULT 0,
+	updated_at      BIGINT      NOT NULL DEFAULT 0,
+	PRIMARY KEY (channel, order_no)
+)`, this.table)
+	if _, err := this.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	channel    VARCHAR(32) NOT NULL,
+	order_no   VARCHAR(64) NOT NULL,
+	refund_key VARCHAR(64) NOT NULL,
+	amount     BIGINT      NOT NULL DEFAULT 0,
+	created_at BIGINT      NOT NULL DEFAULT 0,
+	PRIMARY KEY (channel, order_no, refund_key)
+)`, this.refundTable())
+	if _, err := this.db.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	query = fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	notify_key  VARCHAR(191) NOT NULL,
+	done        SMALLINT     NOT NULL DEFAULT 0,
+	reserved_at BIGINT       NOT NULL DEFAULT 0,
+	PRIMARY KEY (notify_key)
+)`, this.notifyTable())
+	_, err := this.db.ExecContext(ctx, query)
+	return err
+}
+
+func (this *SQLStore) notifyTable() string {
+	return this.table + "_notify"
+}
+
+func (this *SQLStore) refundTable() string {
+	return this.table + "_refund"
+}
+
+func (this *SQLStore) AddPayment(ctx context.Context, record *PaymentRecord) error {
+	var now = time.Now()
+	var createdAt = record.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = now
+	}
+
+	_, err := this.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (channel, order_no, trade_no, status, amount, currency, expires_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, this.table),
+		record.Channel, record.OrderNo, record.TradeNo, record.Status, record.Amount.Amount, record.Amount.Currency, unixTime(record.ExpiresAt), unixTime(createdAt), unixTime(now))
+	if err == nil {
+		return nil
+	}
+
+	// 不同数据库主键冲突的错误不一样，通过查询判断订单是否已经存在
+	if _, qErr := this.GetPayment(ctx, record.Channel, record.OrderNo); qErr == nil {
+		return ErrPaymentExists
+	}
+	return err
+}
+
+func (this *SQLStore) UpdatePayment(ctx context.Context, record *PaymentRecord, from string) error {
+	var query = fmt.Sprintf(`UPDATE %s SET trade_no = CASE WHEN ? = '' THEN trade_no ELSE ? END, status = CASE WHEN ? = '' THEN status ELSE ? END, expires_at = CASE WHEN ? = 0 THEN expires_at ELSE ? END, updated_at = ? WHERE channel = ? AND order_no = ? AND status = ?`, this.table)
+	var expiresAt = unixTime(record.ExpiresAt)
+	rs, err := this.db.ExecContext(ctx, query, record.TradeNo, record.TradeNo, record.Status, record.Status, expiresAt, expiresAt, unixTime(time.Now()), record.Channel, record.OrderNo, from)
+	if err != nil {
+		return err
+	}
+	n, err := rs.RowsAffected()
+	if err != nil || n > 0 {
+		return err
+	}
+
+	// MySQL 在数据没有变化时影响的行数为 0，需要重新查询判断原因
+	var status string
+	err = this.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT status FROM %s WHERE channel = ? AND order_no = ?`, this.table), record.Channel, record.OrderNo).Scan(&status)
+	if err == sql.ErrNoRows {
+		return ErrPaymentNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if status != from {
+		return ErrPaymentStateChanged
+	}
+	return nil
+}
+
+func (this *SQLStore) AddRefund(ctx context.Context, channel, orderNo, refundKey string, amount Money) (*PaymentRecord, error) {
+	if err := this.addRefund(ctx, channel, orderNo, refundKey, amount); err != nil {
+		return nil, err
+	}
+	return this.GetPayment(ctx, channel, orderNo)
+}
+
+// addRefund 在同一事务中保存退款记录并累加订单的退款金额，退款记录已经存在时不做任何处理
+func (this *SQLStore) addRefund(ctx context.Context, channel, orderNo, refundKey string, amount Money) (err error) {
+	tx, err := this.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+
+	// 先更新订单，锁定该订单的数据，同一订单的退款依次处理
+	var now = unixTime(time.Now())
+	rs, err := tx.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET refunded_amount = refunded_amount + ?, updated_at = ? WHERE channel = ? AND order_no = ?`, this.table), amount.Amount, now, channel, orderNo)
+	if err != nil {
+		return err
+	}
+	n, err := rs.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		// MySQL 在数据没有变化时影响的行数为 0，需要重新查询判断订单是否存在
+		var count int
+		if err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE channel = ? AND order_no = ?`, this.table), channel, orderNo).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrPaymentNotFound
+		}
+	}
+
+	var count int
+	if err = tx.QueryRowContext(ctx, fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE channel = ? AND order_no = ? AND refund_key = ?`, this.refundTable()), channel, orderNo, refundKey).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		// 该退款已经累加过，回滚本次的更新
+		tx.Rollback()
+		return nil
+	}
+
+	if _, err = tx.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (channel, order_no, refund_key, amount, created_at) VALUES (?, ?, ?, ?, ?)`, this.refundTable()), channel, orderNo, refundKey, amount.Amount, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (this *SQLStore) GetPayment(ctx context.Context, channel, orderNo string) (*PaymentRecord, error) {
+	var query = fmt.Sprintf(`SELECT channel, order_no, trade_no, status, amount, currency, expires_at, created_at, updated_at, refunded_amount FROM %s WHERE channel = ? AND order_no = ?`, this.table)
+
+	r, err := scanPayment(this.db.QueryRowContext(ctx, query, channel, orderNo))
+	if err == sql.ErrNoRows {
+		return nil, ErrPaymentNotFound
+	}
+	return r, err
+}
+
+func (this *SQLStore) FindRefunds(ctx context.Context, channel, orderNo string) ([]string, error) {
+	rows, err := this.db.QueryContext(ctx, fmt.Sprintf(`SELECT refund_key FROM %s WHERE channel = ? AND order_no = ? ORDER BY created_at, refund_key`, this.refundTable()), channel, orderNo)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = make([]string, 0)
+	for rows.Next() {
+		var refundKey string
+		if err = rows.Scan(&refundKey); err != nil {
+			return nil, err
+		}
+		result = append(result, refundKey)
+	}
+	return result, rows.Err()
+}
+
+func (this *SQLStore) Reserve(ctx context.Context, key string) (bool, error) {
+	// 清除处理超时的标记
+	var expired = unixTime(time.Now().Add(-k_NOTIFY_RESERVE_TIMEOUT))
+	if _, err := this.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE notify_key = ? AND done = 0 AND reserved_at < ?`, this.notifyTable()), key, expired); err != nil {
+		return false, err
+	}
+
+	// 通过主键保证同一通知只有一个请求能够标记成功
+	_, err := this.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO %s (notify_key, done, reserved_at) VALUES (?, 0, ?)`, this.notifyTable()), key, unixTime(time.Now()))
+	if err == nil {
+		return true, nil
+	}
+
+	var done int
+	if qErr := this.db.QueryRowContext(ctx, fmt.Sprintf(`SELECT done FROM %s WHERE notify_key = ?`, this.notifyTable()), key).Scan(&done); qErr != nil {
+		// 标记不存在说明插入失败不是主键冲突导致的
+		return false, err
+	}
+	if done == 0 {
+		return false, ErrNotifyProcessing
+	}
+	return false, nil
+}
+
+func (this *SQLStore) Confirm(ctx context.Context, key string) error {
+	_, err := this.db.ExecContext(ctx, fmt.Sprintf(`UPDATE %s SET done = 1 WHERE notify_key = ?`, this.notifyTable()), key)
+	return err
+}
+
+func (this *SQLStore) Release(ctx context.Context, key string) error {
+	_, err := this.db.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %s WHERE notify_key = ? AND done = 0`, this.notifyTable()), key)
+	return err
+}
+
+func (this *SQLStore) FindPayments(ctx context.Context, query *PaymentQuery) ([]*PaymentRecord, error) {
+	var where = "1 = 1"
+	var args []interface{}
+	if query.Channel != "" {
+		where += " AND channel = ?"
+		args = append(args, query.Channel)
+	}
+	if len(query.Statuses) > 0 {
+		where += " AND status IN (?" + strings.Repeat(", ?", len(query.Statuses)-1) + ")"
+		for _, status := range query.Statuses {
+			args = append(args, status)
+		}
+	}
+	if !query.ExpiresBefore.IsZero() {
+		where += " AND expires_at > 0 AND expires_at < ?"
+		args = append(args, unixTime(query.ExpiresBefore))
+	}
+	if !query.CreatedAfter.IsZero() {
+		where += " AND created_at >= ?"
+		args = append(args, unixTime(query.CreatedAfter))
+	}
+	if !query.CreatedBefore.IsZero() {
+		where += " AND created_at < ?"
+		args = append(args, unixTime(query.CreatedBefore))
+	}
+
+	var sqlStr = fmt.Sprintf(`SELECT channel, order_no, trade_no, status, amount, currency, expires_at, created_at, updated_at, refunded_amount FROM %s WHERE %s ORDER BY created_at, channel, order_no`, this.table, where)
+	if query.Limit > 0 {
+		sqlStr += fmt.Sprintf(" LIMIT %d OFFSET %d", query.Limit, query.Offset)
+	}
+
+	rows, err := this.db.QueryContext(ctx, sqlStr, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result = make([]*PaymentRecord, 0)
+	for rows.Next() {
+		r, err := scanPayment(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPayment(row rowScanner) (*PaymentRecord, error) {
+	var r = &PaymentRecord{}
+	var expiresAt, createdAt, updatedAt int64
+	if err := row.Scan(&r.Channel, &r.OrderNo, &r.TradeNo, &r.Status, &r.Amount.Amount, &r.Amount.Currency, &expiresAt, &createdAt, &updatedAt, &r.RefundedAmount.Amount); err != nil {
+		return nil, err
+	}
+	r.RefundedAmount.Currency = r.Amount.Currency
+	r.ExpiresAt = fromUnixTime(expiresAt)
+	r.CreatedAt = fromUnixTime(createdAt)
+	r.UpdatedAt = fromUnixTime(updatedAt)
+	return r, nil
+}
+
+// unixTime 零值保存为 0
+func unixTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func fromUnixTime(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
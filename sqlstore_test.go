@@ -0,0 +1,49 @@
+package pay4go
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	// 只在测试中使用，纯 Go 实现的 SQLite 驱动，不需要 cgo，
+	// SQLStore 的 SQL 语句需要在真实的数据库中执行才能验证
+	_ "modernc.org/sqlite"
+)
+
+// newTestSQLStore 使用 SQLite 内存数据库，每个连接都是独立的数据库，所以只使用一个连接
+func newTestSQLStore(t *testing.T) *SQLStore {
+	db, err := sql.Open("sqlite", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.SetMaxOpenConns(1)
+	t.Cleanup(func() {
+		db.Close()
+	})
+
+	var s = NewSQLStore(db, "")
+	if err = s.CreateTable(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSQLStorePayment(t *testing.T) {
+	testStorePayment(t, newTestSQLStore(t))
+}
+
+func TestSQLStoreFindPayments(t *testing.T) {
+	testStoreFindPayments(t, newTestSQLStore(t))
+}
+
+func TestSQLStoreNotify(t *testing.T) {
+	testNotifyStore(t, newTestSQLStore(t))
+}
+
+func TestSQLStoreAddRefund(t *testing.T) {
+	testStoreAddRefund(t, newTestSQLStore(t))
+}
+
+func TestSQLStoreFindRefunds(t *testing.T) {
+	testStoreFindRefunds(t, newTestSQLStore(t))
+}
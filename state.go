@@ -0,0 +1,165 @@
+package pay4go
+
+import "context"
+
+// 订单状态，只有设置了 Store 的 Service 才会维护订单状态
+const (
+	K_ORDER_STATE_CREATED            = "created"            // 订单已经保存，还未在支付渠道创建
+	K_ORDER_STATE_PENDING            = "pending"            // 等待支付
+	K_ORDER_STATE_PAID               = "paid"               // 支付成功
+	K_ORDER_STATE_PARTIALLY_REFUNDED = "partially_refunded" // 部分退款
+	K_ORDER_STATE_REFUNDED           = "refunded"           // 全额退款
+	K_ORDER_STATE_CLOSED             = "closed"             // 订单已关闭
+	K_ORDER_STATE_EXPIRED            = "expired"            // 订单已过期，之后会被关闭
+)
+
+const (
+	k_ORDER_TRANSIT_RETRY = 3
+)
+
+// orderTransitions 合法的订单状态变更
+var orderTransitions = map[string][]string{
+	K_ORDER_STATE_CREATED:            {K_ORDER_STATE_PENDING, K_ORDER_STATE_PAID, K_ORDER_STATE_CLOSED, K_ORDER_STATE_EXPIRED},
+	K_ORDER_STATE_PENDING:            {K_ORDER_STATE_PAID, K_ORDER_STATE_CLOSED, K_ORDER_STATE_EXPIRED},
+	K_ORDER_STATE_PAID:               {K_ORDER_STATE_PARTIALLY_REFUNDED, K_ORDER_STATE_REFUNDED},
+	K_ORDER_STATE_PARTIALLY_REFUNDED: {K_ORDER_STATE_REFUNDED},
+	K_ORDER_STATE_EXPIRED:            {K_ORDER_STATE_CLOSED, K_ORDER_STATE_PAID}, // 关闭之前用户仍然可能完成支付
+}
+
+func canTransit(from, to string) bool {
+	return contains(orderTransitions[from], to)
+}
+
+// canReach 判断订单能否从 from 经过若干次状态变更到达 to
+func canReach(from, to string) bool {
+	var visited = map[string]bool{from: true}
+	var queue = []string{from}
+	for len(queue) > 0 {
+		var state = queue[0]
+		queue = queue[1:]
+		for _, next := range orderTransitions[state] {
+			if next == to {
+				return true
+			}
+			if !visited[next] {
+				visited[next] = true
+				queue = append(queue, next)
+			}
+		}
+	}
+	return false
+}
+
+// orderStateWithTradeStatus 将统一的交易状态转换为订单状态，支付失败的订单可以重新支付，不改变订单状态
+func orderStateWithTradeStatus(status string) string {
+	switch status {
+	case K_TRADE_STATUS_PENDING, K_TRADE_STATUS_UNDER_REVIEW:
+		return K_ORDER_STATE_PENDING
+	case K_TRADE_STATUS_PAID:
+		return K_ORDER_STATE_PAID
+	case K_TRADE_STATUS_PARTIALLY_REFUNDED:
+		return K_ORDER_STATE_PARTIALLY_REFUNDED
+	case K_TRADE_STATUS_REFUNDED:
+		return K_ORDER_STATE_REFUNDED
+	case K_TRADE_STATUS_CLOSED:
+		return K_ORDER_STATE_CLOSED
+	}
+	return ""
+}
+
+// OnStateChanged 订阅订单状态变更事件，Event.From 和 Event.To 分别为变更前后的订单状态
+func (this *Service) OnStateChanged(fn EventHandler) {
+	this.subscribe(K_EVENT_TYPE_STATE_CHANGED, fn)
+}
+
+// transit 将订单状态变更为 record.Status，同时更新渠道交易号及过期时间，并分发状态变更事件。
+// 订单已经处于 record.Status 之后的状态时（例如重复或者延迟到达的通知）忽略该变更，
+// 状态变更不合法时（例如退款通知先于支付通知到达）返回 *StateTransitionError，
+// 订单状态保存之后才会分发事件，事件处理失败不会回滚订单状态。
+func (this *Service) transit(ctx context.Context, record *PaymentRecord) error {
+	var store = this.getStore()
+	if store == nil || record.OrderNo == "" {
+		return nil
+	}
+
+	for i := 0; i < k_ORDER_TRANSIT_RETRY; i++ {
+		current, err := store.GetPayment(ctx, record.Channel, record.OrderNo)
+		if err == ErrPaymentNotFound {
+			// 订单不是通过 Service 创建的，不知道订单金额时不保存，避免之后的金额校验失败
+			if record.Status == "" || record.Amount.Currency == "" {
+				return nil
+			}
+			if err = store.AddPayment(ctx, record); err == ErrPaymentExists {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		var from, to = current.Status, record.Status
+		var changed = to != "" && to != from
+		if changed && !canTransit(from, to) {
+			if !canReach(to, from) {
+				return &StateTransitionError{Channel: record.Channel, OrderNo: record.OrderNo, From: from, To: to}
+			}
+			changed = false
+		}
+		if !changed && (record.TradeNo == "" || record.TradeNo == current.TradeNo) && (record.ExpiresAt.IsZero() || record.ExpiresAt.Equal(current.ExpiresAt)) {
+			return nil
+		}
+
+		var update = &PaymentRecord{}
+		update.Channel = record.Channel
+		update.OrderNo = record.OrderNo
+		update.TradeNo = record.TradeNo
+		update.ExpiresAt = record.ExpiresAt
+		if changed {
+			update.Status = to
+		}
+		err = store.UpdatePayment(ctx, update, from)
+		if err == ErrPaymentStateChanged {
+			continue
+		}
+		if err != nil || !changed {
+			return err
+		}
+
+		var event = &Event{}
+		event.Type = K_EVENT_TYPE_STATE_CHANGED
+		event.Channel = record.Channel
+		event.OrderNo = record.OrderNo
+		event.TradeNo = record.TradeNo
+		if event.TradeNo == "" {
+			event.TradeNo = current.TradeNo
+		}
+		event.From = from
+		event.To = to
+		return this.emit(ctx, event)
+	}
+	return ErrPaymentStateChanged
+}
+
+// refundState 将退款金额累加到 Store 中保存的订单，根据累计的退款金额判断订单是全额退款还是部分退款。
+// refundKey 用于避免同一笔退款重复累加，为空或者 Store 中没有该订单时只根据本次的退款金额和 total 判断，total 也为空时返回空字符串
+func (this *Service) refundState(ctx context.Context, channel, orderNo, refundKey string, refundAmount, total Money) (string, error) {
+	var store = this.getStore()
+	if store != nil && refundKey != "" {
+		record, err := store.AddRefund(ctx, channel, orderNo, refundKey, refundAmount)
+		if err != nil && err != ErrPaymentNotFound {
+			return "", err
+		}
+		if err == nil {
+			refundAmount = record.RefundedAmount
+			total = record.Amount
+		}
+	}
+	if total.Currency == "" {
+		return "", nil
+	}
+	if refundAmount.Amount >= total.Amount {
+		return K_ORDER_STATE_REFUNDED, nil
+	}
+	return K_ORDER_STATE_PARTIALLY_REFUNDED, nil
+}
@@ -0,0 +1,155 @@
+package pay4go
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCanTransit(t *testing.T) {
+	var tests = []struct {
+		from string
+		to   string
+		ok   bool
+	}{
+		{K_ORDER_STATE_CREATED, K_ORDER_STATE_PENDING, true},
+		{K_ORDER_STATE_CREATED, K_ORDER_STATE_PAID, true},
+		{K_ORDER_STATE_PENDING, K_ORDER_STATE_PAID, true},
+		{K_ORDER_STATE_PENDING, K_ORDER_STATE_EXPIRED, true},
+		{K_ORDER_STATE_EXPIRED, K_ORDER_STATE_CLOSED, true},
+		{K_ORDER_STATE_EXPIRED, K_ORDER_STATE_PAID, true},
+		{K_ORDER_STATE_PAID, K_ORDER_STATE_PARTIALLY_REFUNDED, true},
+		{K_ORDER_STATE_PAID, K_ORDER_STATE_REFUNDED, true},
+		{K_ORDER_STATE_PARTIALLY_REFUNDED, K_ORDER_STATE_REFUNDED, true},
+		{K_ORDER_STATE_PENDING, K_ORDER_STATE_REFUNDED, false},
+		{K_ORDER_STATE_PAID, K_ORDER_STATE_CLOSED, false},
+		{K_ORDER_STATE_PAID, K_ORDER_STATE_PENDING, false},
+		{K_ORDER_STATE_CLOSED, K_ORDER_STATE_PAID, false},
+		{K_ORDER_STATE_REFUNDED, K_ORDER_STATE_PAID, false},
+	}
+
+	for _, test := range tests {
+		if ok := canTransit(test.from, test.to); ok != test.ok {
+			t.Errorf("canTransit(%q, %q) = %v，期望 %v", test.from, test.to, ok, test.ok)
+		}
+	}
+}
+
+func TestCanReach(t *testing.T) {
+	var tests = []struct {
+		from string
+		to   string
+		ok   bool
+	}{
+		{K_ORDER_STATE_CREATED, K_ORDER_STATE_REFUNDED, true},
+		{K_ORDER_STATE_PENDING, K_ORDER_STATE_CLOSED, true},
+		{K_ORDER_STATE_EXPIRED, K_ORDER_STATE_REFUNDED, true},
+		{K_ORDER_STATE_PAID, K_ORDER_STATE_PENDING, false},
+		{K_ORDER_STATE_CLOSED, K_ORDER_STATE_PAID, false},
+		{K_ORDER_STATE_REFUNDED, K_ORDER_STATE_PARTIALLY_REFUNDED, false},
+	}
+
+	for _, test := range tests {
+		if ok := canReach(test.from, test.to); ok != test.ok {
+			t.Errorf("canReach(%q, %q) = %v，期望 %v", test.from, test.to, ok, test.ok)
+		}
+	}
+}
+
+func TestTransit(t *testing.T) {
+	var ctx = context.Background()
+	var s = NewService()
+	s.SetStore(NewMemoryStore())
+
+	var changes []string
+	s.OnStateChanged(func(ctx context.Context, event *Event) error {
+		changes = append(changes, event.From+">"+event.To)
+		return nil
+	})
+
+	if err := s.getStore().AddPayment(ctx, &PaymentRecord{Channel: "test", OrderNo: "o1", Status: K_ORDER_STATE_CREATED, Amount: NewMoney(100, K_CURRENCY_CNY)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		to      string
+		status  string // 变更之后的订单状态
+		illegal bool
+	}{
+		{K_ORDER_STATE_PENDING, K_ORDER_STATE_PENDING, false},
+		{K_ORDER_STATE_PAID, K_ORDER_STATE_PAID, false},
+		{K_ORDER_STATE_PAID, K_ORDER_STATE_PAID, false},    // 重复的通知
+		{K_ORDER_STATE_PENDING, K_ORDER_STATE_PAID, false}, // 延迟到达的通知
+		{K_ORDER_STATE_CLOSED, K_ORDER_STATE_PAID, true},
+		{K_ORDER_STATE_PARTIALLY_REFUNDED, K_ORDER_STATE_PARTIALLY_REFUNDED, false},
+		{K_ORDER_STATE_REFUNDED, K_ORDER_STATE_REFUNDED, false},
+		{K_ORDER_STATE_PARTIALLY_REFUNDED, K_ORDER_STATE_REFUNDED, false},
+	}
+
+	for i, test := range tests {
+		var err = s.transit(ctx, &PaymentRecord{Channel: "test", OrderNo: "o1", Status: test.to})
+		if _, ok := err.(*StateTransitionError); ok != test.illegal || (err != nil && !ok) {
+			t.Fatalf("%d: transit(%q) 错误为 %v", i, test.to, err)
+		}
+		record, err := s.getStore().GetPayment(ctx, "test", "o1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Status != test.status {
+			t.Fatalf("%d: transit(%q) 之后的订单状态为 %q，期望 %q", i, test.to, record.Status, test.status)
+		}
+	}
+
+	var expected = []string{"created>pending", "pending>paid", "paid>partially_refunded", "partially_refunded>refunded"}
+	if len(changes) != len(expected) {
+		t.Fatalf("状态变更事件为 %v，期望 %v", changes, expected)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatalf("状态变更事件为 %v，期望 %v", changes, expected)
+		}
+	}
+}
+
+func TestRefundState(t *testing.T) {
+	var ctx = context.Background()
+	var s = NewService()
+	s.SetStore(NewMemoryStore())
+
+	if err := s.getStore().AddPayment(ctx, &PaymentRecord{Channel: "test", OrderNo: "o1", Status: K_ORDER_STATE_PAID, Amount: NewMoney(100, K_CURRENCY_CNY)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		orderNo   string
+		refundKey string
+		amount    int64
+		total     Money
+		status    string
+	}{
+		{"o1", "r1", 30, Money{}, K_ORDER_STATE_PARTIALLY_REFUNDED},
+		{"o1", "r1", 30, Money{}, K_ORDER_STATE_PARTIALLY_REFUNDED}, // 重复的退款不会累加
+		{"o1", "r2", 30, Money{}, K_ORDER_STATE_PARTIALLY_REFUNDED},
+		{"o1", "r3", 40, Money{}, K_ORDER_STATE_REFUNDED},
+		{"o2", "r1", 40, Money{}, ""},                                                     // 不知道订单金额
+		{"o2", "r1", 40, NewMoney(100, K_CURRENCY_CNY), K_ORDER_STATE_PARTIALLY_REFUNDED}, // 通知中带有订单金额
+		{"o2", "r2", 100, NewMoney(100, K_CURRENCY_CNY), K_ORDER_STATE_REFUNDED},
+	}
+
+	for i, test := range tests {
+		status, err := s.refundState(ctx, "test", test.orderNo, test.refundKey, NewMoney(test.amount, K_CURRENCY_CNY), test.total)
+		if err != nil {
+			t.Fatalf("%d: refundState 错误为 %v", i, err)
+		}
+		if status != test.status {
+			t.Fatalf("%d: refundState = %q，期望 %q", i, status, test.status)
+		}
+	}
+
+	record, err := s.getStore().GetPayment(ctx, "test", "o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.RefundedAmount.Amount != 100 {
+		t.Fatalf("累计的退款金额为 %v，期望 1.00", record.RefundedAmount)
+	}
+}
@@ -0,0 +1,300 @@
+package pay4go
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PaymentRecord 保存在 Store 中的订单信息
+type PaymentRecord struct {
+	Channel   string    `json:"channel"`
+	OrderNo   string    `json:"order_no"`
+	TradeNo   string    `json:"trade_no"`
+	Status    string    `json:"status"` // 订单状态，K_ORDER_STATE_*
+	Amount    Money     `json:"amount"`
+	ExpiresAt time.Time `json:"expires_at"` // 支付的过期时间，为零值表示由支付渠道决定
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	RefundedAmount Money `json:"refunded_amount"` // 累计的退款金额，由 Store.AddRefund 更新
+}
+
+// PaymentQuery 查询订单的条件，为空的条件不做限制
+type PaymentQuery struct {
+	Channel       string
+	Statuses      []string
+	ExpiresBefore time.Time // 过期时间早于该时间的订单，不包含没有过期时间的订单
+	CreatedAfter  time.Time // 创建时间不早于该时间的订单
+	CreatedBefore time.Time // 创建时间早于该时间的订单
+	Limit         int
+	Offset        int // 与 Limit 一起使用进行分页
+}
+
+const (
+	k_STORE_PAGE_SIZE = 500
+)
+
+// Store 保存通过 Service 创建的订单信息，Service 会在创建订单、收到通知以及查询交易时自动更新
+type Store interface {
+	// AddPayment 保存新的订单信息，订单已经存在时返回 ErrPaymentExists，不会覆盖原有的信息
+	AddPayment(ctx context.Context, record *PaymentRecord) error
+
+	// UpdatePayment 更新订单的渠道交易号、状态及过期时间，为空的字段不会被更新，订单不存在时返回 ErrPaymentNotFound，
+	// 只有订单当前的状态为 from 时才会更新，否则返回 ErrPaymentStateChanged
+	UpdatePayment(ctx context.Context, record *PaymentRecord, from string) error
+
+	// AddRefund 累加订单的退款金额，同一 refundKey 的退款只会累加一次，返回累加之后的订单信息，订单不存在时返回 ErrPaymentNotFound
+	AddRefund(ctx context.Context, channel, orderNo, refundKey string, amount Money) (*PaymentRecord, error)
+
+	// FindRefunds 查询订单已经累加的退款的 refundKey，按照累加的时间升序排列，没有退款时返回空列表
+	FindRefunds(ctx context.Context, channel, orderNo string) ([]string, error)
+
+	// GetPayment 获取订单信息，订单不存在时返回 ErrPaymentNotFound
+	GetPayment(ctx context.Context, channel, orderNo string) (*PaymentRecord, error)
+
+	// FindPayments 查询符合条件的订单，按照创建时间、支付渠道及订单号升序排列
+	FindPayments(ctx context.Context, query *PaymentQuery) ([]*PaymentRecord, error)
+}
+
+// storeSetter 需要查询订单信息的支付渠道（PayPal、支付宝）实现该接口，由 Service 设置 Store
+type storeSetter interface {
+	SetStore(store Store)
+}
+
+// SetStore 设置用于保存订单信息的 Store，为 nil 时不保存，同时会设置给已经注册的需要查询订单信息的支付渠道
+func (this *Service) SetStore(store Store) {
+	this.mu.Lock()
+	this.store = store
+	for _, c := range this.channels {
+		if s, ok := c.(storeSetter); ok {
+			s.SetStore(store)
+		}
+	}
+	this.mu.Unlock()
+}
+
+func (this *Service) getStore() Store {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+	return this.store
+}
+
+func (this *Service) recordTrade(ctx context.Context, trade *Trade) error {
+	var record = &PaymentRecord{}
+	record.Channel = trade.Channel
+	record.OrderNo = trade.OrderNo
+	record.TradeNo = trade.TradeNo
+	record.Status = orderStateWithTradeStatus(trade.Status)
+	record.Amount = trade.TotalAmount
+	return this.transit(ctx, record)
+}
+
+func (this *Service) recordNotification(ctx context.Context, noti *Notification) (err error) {
+	if noti.Trade != nil {
+		return this.recordTrade(ctx, noti.Trade)
+	}
+
+	var record = &PaymentRecord{}
+	record.Channel = noti.Channel
+	record.OrderNo = noti.OrderNo
+	record.TradeNo = noti.TradeNo
+	record.Status = orderStateWithTradeStatus(noti.Status)
+	record.Amount = noti.Amount
+
+	// 微信支付及 PayPal 的退款通知不包含交易状态，需要根据累计的退款金额判断
+	if noti.NotifyType == K_NOTIFY_TYPE_REFUND && record.Status == "" && noti.RefundStatus == K_REFUND_STATUS_SUCCESS {
+		var refundKey = noti.RefundId
+		if refundKey == "" {
+			refundKey = noti.RefundNo
+		}
+		if record.Status, err = this.refundState(ctx, noti.Channel, noti.OrderNo, refundKey, noti.RefundAmount, noti.Amount); err != nil {
+			return err
+		}
+	}
+	return this.transit(ctx, record)
+}
+
+// StoreAmountLookup 使用 Store 中保存的订单金额校验通知及同步返回中的金额
+func StoreAmountLookup(store Store) AmountLookup {
+	return AmountLookupFunc(func(ctx context.Context, channel, orderNo string) (Money, bool, error) {
+		record, err := store.GetPayment(ctx, channel, orderNo)
+		if err == ErrPaymentNotFound {
+			return Money{}, false, nil
+		}
+		if err != nil {
+			return Money{}, false, err
+		}
+		return record.Amount, true, nil
+	})
+}
+
+// MemoryStore 将订单信息保存在内存中，进程退出之后数据会丢失，适用于测试及单机部署
+type MemoryStore struct {
+	mu       sync.RWMutex
+	payments map[string]*PaymentRecord
+	refunds  map[string][]string // 订单已经累加的退款的 refundKey
+}
+
+func NewMemoryStore() *MemoryStore {
+	var s = &MemoryStore{}
+	s.payments = make(map[string]*PaymentRecord)
+	s.refunds = make(map[string][]string)
+	return s
+}
+
+func paymentKey(channel, orderNo string) string {
+	return channel + "/" + orderNo
+}
+
+func (this *MemoryStore) AddPayment(ctx context.Context, record *PaymentRecord) error {
+	var r = *record
+	var now = time.Now()
+	if r.CreatedAt.IsZero() {
+		r.CreatedAt = now
+	}
+	r.UpdatedAt = now
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var key = paymentKey(r.Channel, r.OrderNo)
+	if _, ok := this.payments[key]; ok {
+		return ErrPaymentExists
+	}
+	this.payments[key] = &r
+	return nil
+}
+
+func (this *MemoryStore) UpdatePayment(ctx context.Context, record *PaymentRecord, from string) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var r = this.payments[paymentKey(record.Channel, record.OrderNo)]
+	if r == nil {
+		return ErrPaymentNotFound
+	}
+	if r.Status != from {
+		return ErrPaymentStateChanged
+	}
+	if record.TradeNo != "" {
+		r.TradeNo = record.TradeNo
+	}
+	if record.Status != "" {
+		r.Status = record.Status
+	}
+	if !record.ExpiresAt.IsZero() {
+		r.ExpiresAt = record.ExpiresAt
+	}
+	r.UpdatedAt = time.Now()
+	return nil
+}
+
+func (this *MemoryStore) AddRefund(ctx context.Context, channel, orderNo, refundKey string, amount Money) (*PaymentRecord, error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	var key = paymentKey(channel, orderNo)
+	var r = this.payments[key]
+	if r == nil {
+		return nil, ErrPaymentNotFound
+	}
+	if !contains(this.refunds[key], refundKey) {
+		this.refunds[key] = append(this.refunds[key], refundKey)
+		r.RefundedAmount = NewMoney(r.RefundedAmount.Amount+amount.Amount, r.Amount.Currency)
+		r.UpdatedAt = time.Now()
+	}
+	var result = *r
+	return &result, nil
+}
+
+func (this *MemoryStore) FindRefunds(ctx context.Context, channel, orderNo string) ([]string, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var keys = this.refunds[paymentKey(channel, orderNo)]
+	var result = make([]string, len(keys))
+	copy(result, keys)
+	return result, nil
+}
+
+func (this *MemoryStore) GetPayment(ctx context.Context, channel, orderNo string) (*PaymentRecord, error) {
+	this.mu.RLock()
+	defer this.mu.RUnlock()
+
+	var r = this.payments[paymentKey(channel, orderNo)]
+	if r == nil {
+		return nil, ErrPaymentNotFound
+	}
+	var result = *r
+	return &result, nil
+}
+
+func (this *MemoryStore) FindPayments(ctx context.Context, query *PaymentQuery) ([]*PaymentRecord, error) {
+	this.mu.RLock()
+	var result = make([]*PaymentRecord, 0)
+	for _, r := range this.payments {
+		if query.match(r) {
+			var record = *r
+			result = append(result, &record)
+		}
+	}
+	this.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].CreatedAt.Equal(result[j].CreatedAt) {
+			return result[i].CreatedAt.Before(result[j].CreatedAt)
+		}
+		return paymentKey(result[i].Channel, result[i].OrderNo) < paymentKey(result[j].Channel, result[j].OrderNo)
+	})
+	if query.Offset > 0 {
+		if query.Offset >= len(result) {
+			return result[:0], nil
+		}
+		result = result[query.Offset:]
+	}
+	if query.Limit > 0 && len(result) > query.Limit {
+		result = result[:query.Limit]
+	}
+	return result, nil
+}
+
+// findAllPayments 分页查询全部符合条件的订单，忽略 query 的 Limit 和 Offset
+func findAllPayments(ctx context.Context, store Store, query *PaymentQuery) ([]*PaymentRecord, error) {
+	var q = *query
+	q.Limit = k_STORE_PAGE_SIZE
+	q.Offset = 0
+
+	var result []*PaymentRecord
+	for {
+		records, err := store.FindPayments(ctx, &q)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, records...)
+		if len(records) < q.Limit {
+			return result, nil
+		}
+		q.Offset += len(records)
+	}
+}
+
+func (this *PaymentQuery) match(r *PaymentRecord) bool {
+	if this.Channel != "" && this.Channel != r.Channel {
+		return false
+	}
+	if len(this.Statuses) > 0 && !contains(this.Statuses, r.Status) {
+		return false
+	}
+	if !this.ExpiresBefore.IsZero() && (r.ExpiresAt.IsZero() || !r.ExpiresAt.Before(this.ExpiresBefore)) {
+		return false
+	}
+	if !this.CreatedAfter.IsZero() && r.CreatedAt.Before(this.CreatedAfter) {
+		return false
+	}
+	if !this.CreatedBefore.IsZero() && !r.CreatedAt.Before(this.CreatedBefore) {
+		return false
+	}
+	return true
+}
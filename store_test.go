@@ -0,0 +1,197 @@
+package pay4go
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// 以下测试同时用于 MemoryStore 和 SQLStore，SQLStore 的测试见 sqlstore_test.go
+
+func testStorePayment(t *testing.T, s Store) {
+	var ctx = context.Background()
+	var expiresAt = time.Date(2018, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	var record = &PaymentRecord{}
+	record.Channel = "test"
+	record.OrderNo = "o1"
+	record.Status = K_ORDER_STATE_CREATED
+	record.Amount = NewMoney(1234, K_CURRENCY_CNY)
+	if err := s.AddPayment(ctx, record); err != nil {
+		t.Fatal(err)
+	}
+
+	// 已经存在的订单不会被覆盖
+	var dup = *record
+	dup.Status = K_ORDER_STATE_PENDING
+	dup.Amount = NewMoney(1, K_CURRENCY_CNY)
+	if err := s.AddPayment(ctx, &dup); err != ErrPaymentExists {
+		t.Fatalf("重复保存订单的错误为 %v，期望 %v", err, ErrPaymentExists)
+	}
+
+	var tests = []struct {
+		update *PaymentRecord
+		from   string
+		err    error
+	}{
+		{&PaymentRecord{Channel: "test", OrderNo: "o1", Status: K_ORDER_STATE_PENDING, TradeNo: "t1", ExpiresAt: expiresAt}, K_ORDER_STATE_CREATED, nil},
+		{&PaymentRecord{Channel: "test", OrderNo: "o1", Status: K_ORDER_STATE_PAID}, K_ORDER_STATE_CREATED, ErrPaymentStateChanged},
+		{&PaymentRecord{Channel: "test", OrderNo: "o1"}, K_ORDER_STATE_PENDING, nil}, // 为空的字段不会被更新
+		{&PaymentRecord{Channel: "test", OrderNo: "o2", Status: K_ORDER_STATE_PAID}, K_ORDER_STATE_CREATED, ErrPaymentNotFound},
+	}
+	for i, test := range tests {
+		if err := s.UpdatePayment(ctx, test.update, test.from); err != test.err {
+			t.Fatalf("%d: UpdatePayment 错误为 %v，期望 %v", i, err, test.err)
+		}
+	}
+
+	r, err := s.GetPayment(ctx, "test", "o1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Status != K_ORDER_STATE_PENDING || r.TradeNo != "t1" || !r.ExpiresAt.Equal(expiresAt) || r.Amount != record.Amount || r.CreatedAt.IsZero() {
+		t.Fatalf("订单信息为 %+v", r)
+	}
+	if _, err = s.GetPayment(ctx, "test", "o2"); err != ErrPaymentNotFound {
+		t.Fatalf("获取不存在的订单的错误为 %v，期望 %v", err, ErrPaymentNotFound)
+	}
+}
+
+func testStoreFindPayments(t *testing.T, s Store) {
+	var ctx = context.Background()
+	var base = time.Date(2018, 1, 2, 10, 0, 0, 0, time.UTC)
+
+	var records = []*PaymentRecord{
+		{Channel: "test", OrderNo: "o3", Status: K_ORDER_STATE_PENDING, CreatedAt: base.Add(2 * time.Minute), ExpiresAt: base.Add(time.Hour)},
+		{Channel: "test", OrderNo: "o1", Status: K_ORDER_STATE_PENDING, CreatedAt: base, ExpiresAt: base.Add(time.Hour)},
+		{Channel: "test", OrderNo: "o2", Status: K_ORDER_STATE_PAID, CreatedAt: base.Add(time.Minute)},
+		{Channel: "test", OrderNo: "o4", Status: K_ORDER_STATE_CREATED, CreatedAt: base.Add(2 * time.Minute), ExpiresAt: base.Add(2 * time.Hour)},
+		{Channel: "other", OrderNo: "o5", Status: K_ORDER_STATE_PENDING, CreatedAt: base.Add(3 * time.Minute)},
+	}
+	for _, r := range records {
+		r.Amount = NewMoney(100, K_CURRENCY_CNY)
+		if err := s.AddPayment(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		name     string
+		query    *PaymentQuery
+		orderNos []string
+	}{
+		{"全部", &PaymentQuery{}, []string{"o1", "o2", "o3", "o4", "o5"}},
+		{"支付渠道", &PaymentQuery{Channel: "other"}, []string{"o5"}},
+		{"订单状态", &PaymentQuery{Statuses: []string{K_ORDER_STATE_PENDING, K_ORDER_STATE_CREATED}}, []string{"o1", "o3", "o4", "o5"}},
+		{"过期时间", &PaymentQuery{ExpiresBefore: base.Add(90 * time.Minute)}, []string{"o1", "o3"}},
+		{"创建时间", &PaymentQuery{CreatedAfter: base.Add(time.Minute), CreatedBefore: base.Add(3 * time.Minute)}, []string{"o2", "o3", "o4"}},
+		{"分页", &PaymentQuery{Limit: 2, Offset: 1}, []string{"o2", "o3"}},
+		{"最后一页", &PaymentQuery{Limit: 2, Offset: 4}, []string{"o5"}},
+		{"超出范围", &PaymentQuery{Limit: 2, Offset: 5}, []string{}},
+	}
+	for _, test := range tests {
+		result, err := s.FindPayments(ctx, test.query)
+		if err != nil {
+			t.Fatalf("%s: FindPayments 错误为 %v", test.name, err)
+		}
+		var orderNos = make([]string, 0, len(result))
+		for _, r := range result {
+			orderNos = append(orderNos, r.OrderNo)
+		}
+		if len(orderNos) != len(test.orderNos) {
+			t.Fatalf("%s: 查询结果为 %v，期望 %v", test.name, orderNos, test.orderNos)
+		}
+		for i := range orderNos {
+			if orderNos[i] != test.orderNos[i] {
+				t.Fatalf("%s: 查询结果为 %v，期望 %v", test.name, orderNos, test.orderNos)
+			}
+		}
+	}
+
+	all, err := findAllPayments(ctx, s, &PaymentQuery{Statuses: []string{K_ORDER_STATE_PENDING}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 3 {
+		t.Fatalf("findAllPayments 查询到 %d 个订单，期望 3 个", len(all))
+	}
+}
+
+func TestMemoryStorePayment(t *testing.T) {
+	testStorePayment(t, NewMemoryStore())
+}
+
+func TestMemoryStoreFindPayments(t *testing.T) {
+	testStoreFindPayments(t, NewMemoryStore())
+}
+
+func testStoreAddRefund(t *testing.T, s Store) {
+	var ctx = context.Background()
+	if err := s.AddPayment(ctx, &PaymentRecord{Channel: "test", OrderNo: "o1", Status: K_ORDER_STATE_PAID, Amount: NewMoney(100, K_CURRENCY_CNY)}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		orderNo   string
+		refundKey string
+		amount    int64
+		refunded  int64
+		err       error
+	}{
+		{"o1", "r1", 30, 30, nil},
+		{"o1", "r1", 30, 30, nil}, // 同一笔退款只会累加一次
+		{"o1", "r2", 50, 80, nil},
+		{"o2", "r1", 10, 0, ErrPaymentNotFound},
+	}
+	for i, test := range tests {
+		r, err := s.AddRefund(ctx, "test", test.orderNo, test.refundKey, NewMoney(test.amount, K_CURRENCY_CNY))
+		if err != test.err {
+			t.Fatalf("%d: AddRefund 错误为 %v，期望 %v", i, err, test.err)
+		}
+		if err == nil && r.RefundedAmount != NewMoney(test.refunded, K_CURRENCY_CNY) {
+			t.Fatalf("%d: 累计的退款金额为 %+v，期望 %d", i, r.RefundedAmount, test.refunded)
+		}
+	}
+}
+
+func TestMemoryStoreAddRefund(t *testing.T) {
+	testStoreAddRefund(t, NewMemoryStore())
+}
+
+func testStoreFindRefunds(t *testing.T, s Store) {
+	var ctx = context.Background()
+	if err := s.AddPayment(ctx, &PaymentRecord{Channel: "test", OrderNo: "o1", Status: K_ORDER_STATE_PAID, Amount: NewMoney(100, K_CURRENCY_CNY)}); err != nil {
+		t.Fatal(err)
+	}
+	for _, refundKey := range []string{"r1", "r2", "r1"} {
+		if _, err := s.AddRefund(ctx, "test", "o1", refundKey, NewMoney(10, K_CURRENCY_CNY)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		orderNo    string
+		refundKeys []string
+	}{
+		{"o1", []string{"r1", "r2"}},
+		{"o2", []string{}},
+	}
+	for _, test := range tests {
+		refundKeys, err := s.FindRefunds(ctx, "test", test.orderNo)
+		if err != nil {
+			t.Fatalf("%s: FindRefunds 错误为 %v", test.orderNo, err)
+		}
+		if len(refundKeys) != len(test.refundKeys) {
+			t.Fatalf("%s: 查询结果为 %v，期望 %v", test.orderNo, refundKeys, test.refundKeys)
+		}
+		for i := range refundKeys {
+			if refundKeys[i] != test.refundKeys[i] {
+				t.Fatalf("%s: 查询结果为 %v，期望 %v", test.orderNo, refundKeys, test.refundKeys)
+			}
+		}
+	}
+}
+
+func TestMemoryStoreFindRefunds(t *testing.T) {
+	testStoreFindRefunds(t, NewMemoryStore())
+}
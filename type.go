@@ -1,22 +1,70 @@
 package pay4go
 
-import "net/http"
+import (
+	"context"
+	"net/http"
+	"time"
+)
 
 const (
 	K_TRADE_METHOD_WEB    = "web"     // PC 浏览器
 	K_TRADE_METHOD_WAP    = "wap"     // 手机浏览器（支付宝）
 	K_TRADE_METHOD_APP    = "app"     // 生成支付参数，用于 App 上调用相关的 SDK 使用（支付宝、微信支付）
 	K_TRADE_METHOD_QRCODE = "qr_code" // 生成收款二维码，供用户扫码进行支付（支付宝、微信支付）
-	K_TRADE_METHOD_F2F    = "f2f"     // 扫描用户的付款码进行收款
+	K_TRADE_METHOD_F2F    = "f2f"     // 扫描用户的付款码进行收款（支付宝、微信支付）
+
+	K_TRADE_METHOD_JSAPI        = "jsapi"        // 微信公众号内支付，需要提供用户的 OpenId（微信支付）
+	K_TRADE_METHOD_MINI_PROGRAM = "mini_program" // 微信小程序内支付，需要提供用户的 OpenId（微信支付）
+)
+
+const (
+	k_F2F_QUERY_INTERVAL = time.Second * 3  // 扫描用户的付款码进行收款时，查询支付结果的时间间隔
+	k_F2F_QUERY_TIMEOUT  = time.Second * 30 // 扫描用户的付款码进行收款时，等待用户完成支付的最长时间
 )
 
+// PayChannel 支付渠道，ReturnRequestHandler 和 NotifyRequestHandler 使用 req.Context()。
+// 查询类的方法在 ctx 被取消时立即返回；CreateTradeOrderContext、RefundContext、CloseTradeContext 等改变交易状态的方法
+// 只在发起请求之前检查 ctx，请求发出之后会等待支付渠道返回结果，不能被取消
 type PayChannel interface {
 	Identifier() string
-	CreateTradeOrder(order *Order) (url string, err error)
-	GetTrade(tradeNo string) (result *Trade, err error)
-	GetTradeWithOrderNo(orderNo string) (result *Trade, err error)
+	Capability() *Capability
+	CreateTradeOrderContext(ctx context.Context, order *Order) (result *PaymentIntent, err error)
+	GetTradeContext(ctx context.Context, tradeNo string) (result *Trade, err error)
+	GetTradeWithOrderNoContext(ctx context.Context, orderNo string) (result *Trade, err error)
 	ReturnRequestHandler(req *http.Request) (result *Trade, err error)
 	NotifyRequestHandler(req *http.Request) (result *Notification, err error)
+	WriteNotifyResponse(w http.ResponseWriter, err error)
+	RefundContext(ctx context.Context, req *RefundRequest) (result *Refund, err error)
+	GetRefundContext(ctx context.Context, orderNo, refundNo string) (result *Refund, err error)
+	GetRefundsForOrderContext(ctx context.Context, orderNo string) (result []*Refund, err error)
+	CloseTradeContext(ctx context.Context, orderNo string) (err error)
+	DownloadBillContext(ctx context.Context, date time.Time) (result *Bill, err error)
+}
+
+const (
+	K_PAYMENT_KIND_REDIRECT   = "redirect"   // 跳转到 Payload 指定的 URL 进行支付
+	K_PAYMENT_KIND_QRCODE     = "qr"         // Payload 为二维码内容，供用户扫码进行支付
+	K_PAYMENT_KIND_APP_PARAMS = "app_params" // Payload 为 App 调用相关 SDK 需要的支付参数
+	K_PAYMENT_KIND_COMPLETED  = "completed"  // 支付已经完成（扫描用户的付款码进行收款）
+)
+
+// PaymentIntent 创建支付订单的结果
+type PaymentIntent struct {
+	Channel   string            `json:"channel"`
+	Kind      string            `json:"kind"`
+	OrderNo   string            `json:"order_no"`
+	TradeNo   string            `json:"trade_no"`         // 渠道交易号，渠道在创建订单时没有生成交易号的时候为空
+	Payload   string            `json:"payload"`          // 根据 Kind 的不同，分别为 URL、二维码内容和支付参数
+	Params    map[string]string `json:"params,omitempty"` // 支付参数（微信支付 App、JSAPI、小程序），Payload 为其 JSON 格式
+	ExpiresAt time.Time         `json:"expires_at"`       // 过期时间，为零值时表示没有指定过期时间
+}
+
+// expiresAt 根据超时时间（单位为分钟）计算过期时间
+func expiresAt(timeout int) time.Time {
+	if timeout <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Minute * time.Duration(timeout))
 }
 
 type ShippingAddress struct {
@@ -33,25 +81,26 @@ type Product struct {
 	Name     string
 	SKU      string
 	Quantity int
-	Price    float64 // 商品单价
-	Tax      float64 // 商品税费
+	Price    Money // 商品单价
+	Tax      Money // 商品税费
 }
 
 type Order struct {
 	OrderNo         string           // 必须 - 订单编号
 	Subject         string           // 必须 - 订单主题
-	Shipping        float64          // 运费
-	Discount        float64          // 减免金额
+	Shipping        Money            // 运费
+	Discount        Money            // 减免金额
 	ProductList     []*Product       // 商品列表
-	Currency        string           // 货币名称，例如 USD（PayPal）
+	Currency        string           // 货币名称，例如 USD，为空时支付宝和微信支付使用 CNY
 	ShippingAddress *ShippingAddress // 收货地址信息（PayPal）
-	AuthCode        string           // 支付授权码，扫描用户的付款码获取（支付宝）
+	AuthCode        string           // 支付授权码，扫描用户的付款码获取（支付宝、微信支付）
 	TradeMethod     string           // 支付方式（支付宝）
 	IP              string           // 用户端 IP（微信支付）
+	OpenId          string           // 用户在公众号或者小程序下的 OpenId（微信支付 JSAPI、小程序）
 	Timeout         int              // 支付超时时间，单位为分钟（支付宝、微信支付）
 }
 
-func (this *Order) AddProduct(name, sku string, quantity int, price, tax float64) {
+func (this *Order) AddProduct(name, sku string, quantity int, price, tax Money) {
 	var p = &Product{}
 	p.Name = name
 	p.SKU = sku
@@ -61,17 +110,123 @@ func (this *Order) AddProduct(name, sku string, quantity int, price, tax float64
 	this.ProductList = append(this.ProductList, p)
 }
 
+// currency 返回订单的货币名称，没有指定时返回 defaultCurrency
+func (this *Order) currency(defaultCurrency string) string {
+	if this.Currency != "" {
+		return this.Currency
+	}
+	return defaultCurrency
+}
+
+// ProductAmount 返回商品总金额（不含税费）
+func (this *Order) ProductAmount() Money {
+	var amount = NewMoney(0, this.Currency)
+	for _, p := range this.ProductList {
+		amount = amount.Add(p.Price.Mul(p.Quantity))
+	}
+	return amount
+}
+
+// ProductTax 返回商品总税费
+func (this *Order) ProductTax() Money {
+	var tax = NewMoney(0, this.Currency)
+	for _, p := range this.ProductList {
+		tax = tax.Add(p.Tax.Mul(p.Quantity))
+	}
+	return tax
+}
+
+// TotalAmount 返回订单需要支付的总金额，即商品金额 + 商品税费 + 运费 - 减免金额
+func (this *Order) TotalAmount() Money {
+	return this.ProductAmount().Add(this.ProductTax()).Add(this.Shipping).Sub(this.Discount)
+}
+
+const (
+	K_TRADE_STATUS_PENDING            = "pending"            // 等待支付
+	K_TRADE_STATUS_PAID               = "paid"               // 支付成功
+	K_TRADE_STATUS_CLOSED             = "closed"             // 交易关闭，未支付或者已撤销
+	K_TRADE_STATUS_REFUNDED           = "refunded"           // 全额退款
+	K_TRADE_STATUS_PARTIALLY_REFUNDED = "partially_refunded" // 部分退款
+	K_TRADE_STATUS_FAILED             = "failed"             // 支付失败
+	K_TRADE_STATUS_UNDER_REVIEW       = "under_review"       // 支付待审核（PayPal）
+)
+
 type Trade struct {
+	Channel        string    `json:"channel"`
+	OrderNo        string    `json:"order_no"`
+	TradeNo        string    `json:"trade_no"`
+	Status         string    `json:"status"`       // 统一的交易状态
+	TradeStatus    string    `json:"trade_status"` // 支付渠道返回的原始交易状态
+	TradeSuccess   bool      `json:"paid_success"`
+	PayerId        string    `json:"payer_id"`
+	PayerEmail     string    `json:"payer_email"`
+	Currency       string    `json:"currency"`
+	TotalAmount    Money     `json:"total_amount"`
+	Fee            Money     `json:"fee"`             // 支付渠道收取的手续费，渠道未返回时为 0
+	RefundedAmount Money     `json:"refunded_amount"` // 已退款金额
+	NetAmount      Money     `json:"net_amount"`      // 实际到账金额，即 TotalAmount - Fee - RefundedAmount
+	CreatedAt      time.Time `json:"created_at"`      // 交易创建时间，渠道未返回时为零值
+	PaidAt         time.Time `json:"paid_at"`         // 支付时间，未支付时为零值
+
+	RawTrade interface{} `json:"raw_trade"`
+}
+
+// settle 根据交易金额、手续费及已退款金额计算实际到账金额
+func (this *Trade) settle() {
+	var currency = this.TotalAmount.Currency
+	this.Currency = currency
+	if this.Fee.Currency == "" {
+		this.Fee.Currency = currency
+	}
+	if this.RefundedAmount.Currency == "" {
+		this.RefundedAmount.Currency = currency
+	}
+	if this.TradeSuccess || this.Status == K_TRADE_STATUS_PARTIALLY_REFUNDED || this.Status == K_TRADE_STATUS_REFUNDED {
+		this.NetAmount = this.TotalAmount.Sub(this.Fee).Sub(this.RefundedAmount)
+	} else {
+		this.NetAmount = NewMoney(0, currency)
+	}
+}
+
+// k_CHINA_LOCATION 支付宝及微信支付返回的时间均为北京时间
+var k_CHINA_LOCATION = time.FixedZone("CST", 8*60*60)
+
+// parseTime 解析支付渠道返回的时间，为空或者格式不正确时返回零值
+func parseTime(layout, value string, loc *time.Location) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.ParseInLocation(layout, value, loc)
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+const (
+	K_REFUND_STATUS_PROCESSING = "processing" // 退款处理中
+	K_REFUND_STATUS_SUCCESS    = "success"    // 退款成功
+	K_REFUND_STATUS_FAILED     = "failed"     // 退款失败
+)
+
+type RefundRequest struct {
+	OrderNo  string // 必须 - 订单编号
+	TradeNo  string // 渠道交易号（PayPal 必须）
+	RefundNo string // 必须 - 退款编号，同一笔退款重复请求时需要保持一致
+	Amount   Money  // 退款金额，为 0 时表示全额退款
+	Reason   string // 退款原因
+}
+
+type Refund struct {
 	Channel      string `json:"channel"`
 	OrderNo      string `json:"order_no"`
 	TradeNo      string `json:"trade_no"`
-	TradeStatus  string `json:"trade_status"`
-	TradeSuccess bool   `json:"paid_success"`
-	PayerId      string `json:"payer_id"`
-	PayerEmail   string `json:"payer_email"`
-	TotalAmount  string `json:"total_amount"`
+	RefundNo     string `json:"refund_no"`
+	RefundId     string `json:"refund_id"` // 渠道退款单号（微信支付、PayPal）
+	RefundAmount Money  `json:"refund_amount"`
+	RefundStatus string `json:"refund_status"`
 
-	RawTrade interface{} `json:"raw_trade"`
+	RawRefund interface{} `json:"raw_refund"`
 }
 
 const (
@@ -81,10 +236,26 @@ const (
 )
 
 type Notification struct {
-	Channel    string `json:"channel"`
-	NotifyType string `json:"notify_type"`
-	OrderNo    string `json:"order_no"`
-	TradeNo    string `json:"trade_no"`
+	Channel      string `json:"channel"`
+	NotifyType   string `json:"notify_type"`
+	NotifyId     string `json:"notify_id"` // 通知的唯一标识，同一通知重试时不变，用于通知去重
+	OrderNo      string `json:"order_no"`
+	TradeNo      string `json:"trade_no"`
+	Status       string `json:"status"`        // 统一的交易状态，无法从通知中得知时为空
+	TradeStatus  string `json:"trade_status"`  // 支付渠道通知的原始交易状态
+	Amount       Money  `json:"amount"`        // 订单金额
+	PayerId      string `json:"payer_id"`      // 付款方 Id（支付宝、微信支付）
+	PayerEmail   string `json:"payer_email"`   // 付款方账号（支付宝）
+	RefundNo     string `json:"refund_no"`     // 退款编号
+	RefundId     string `json:"refund_id"`     // 渠道退款单号（微信支付、PayPal）
+	RefundStatus string `json:"refund_status"` // 退款状态，退款通知时有值
+	RefundAmount Money  `json:"refund_amount"` // 退款金额，支付宝为该笔交易累计的退款金额
+
+	// Trade 重新查询到的交易信息，只有 Service 开启了 AttachTrade 的交易通知才有值
+	Trade *Trade `json:"trade,omitempty"`
+
+	// Duplicate 该通知之前已经处理成功，不会再分发事件，只有 Service 开启了通知去重才会为 true
+	Duplicate bool `json:"duplicate"`
 
 	RawNotify interface{} `json:"raw_notify"`
 }
@@ -1,10 +1,22 @@
 package pay4go
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"github.com/smartwalle/ngx"
 	"github.com/smartwalle/wxpay"
+	"io/ioutil"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,20 +25,32 @@ const (
 	K_CHANNEL_WXPAY = "wxpay"
 )
 
+const (
+	k_WXPAY_RESULT_CODE_SUCCESS = "SUCCESS"
+)
+
 const (
 	k_WXPAY_NOTIFY_TYPE_TRADE  = "trade"
 	k_WXPAY_NOTIFY_TYPE_REFUND = "refund"
 )
 
 type WXPay struct {
-	location  *time.Location
-	client    *wxpay.WXPay
-	NotifyURL string
+	location     *time.Location
+	client       *wxpay.WXPay
+	appId        string
+	apiKey       string
+	mchId        string
+	isProduction bool
+	NotifyURL    string
 }
 
 func NewWXPal(appId, apiKey, mchId string, isProduction bool) *WXPay {
 	var p = &WXPay{}
 	p.client = wxpay.New(appId, apiKey, mchId, isProduction)
+	p.appId = appId
+	p.apiKey = apiKey
+	p.mchId = mchId
+	p.isProduction = isProduction
 	loc, err := time.LoadLocation("Asia/Chongqing")
 	if err != nil {
 		loc = time.UTC
@@ -35,37 +59,74 @@ func NewWXPal(appId, apiKey, mchId string, isProduction bool) *WXPay {
 	return p
 }
 
+// LoadCert 加载商户证书，退款等接口需要使用
+func (this *WXPay) LoadCert(path string) error {
+	return this.client.LoadCert(path)
+}
+
 func (this *WXPay) Identifier() string {
 	return K_CHANNEL_WXPAY
 }
 
-func (this *WXPay) CreateTradeOrder(order *Order) (url string, err error) {
-	var productAmount float64 = 0
-	var productTax float64 = 0
-	for _, p := range order.ProductList {
-		productAmount += p.Price * float64(p.Quantity)
-		productTax += p.Tax * float64(p.Quantity)
-	}
+func (this *WXPay) Capability() *Capability {
+	var c = &Capability{}
+	c.TradeMethods = []string{K_TRADE_METHOD_WAP, K_TRADE_METHOD_APP, K_TRADE_METHOD_QRCODE, K_TRADE_METHOD_F2F, K_TRADE_METHOD_JSAPI, K_TRADE_METHOD_MINI_PROGRAM}
+	c.Currencies = []string{K_CURRENCY_CNY}
+	c.Features = []string{K_FEATURE_QUERY_BY_ORDER_NO, K_FEATURE_REFUND, K_FEATURE_REFUND_QUERY, K_FEATURE_REFUND_LIST, K_FEATURE_CLOSE_TRADE, K_FEATURE_DOWNLOAD_BILL}
+	return c
+}
+
+func (this *WXPay) CreateTradeOrder(order *Order) (result *PaymentIntent, err error) {
+	return this.CreateTradeOrderContext(context.Background(), order)
+}
+
+func (this *WXPay) CreateTradeOrderContext(ctx context.Context, order *Order) (result *PaymentIntent, err error) {
 	var subject = strings.TrimSpace(order.Subject)
 	if subject == "" {
 		subject = order.OrderNo
 	}
 
-	var amount = int((productAmount + productTax + order.Shipping - order.Discount) * 100)
+	// 微信支付的金额单位为分
+	var amount = int(order.TotalAmount().Amount)
+
+	result = &PaymentIntent{}
+	result.Channel = this.Identifier()
+	result.OrderNo = order.OrderNo
+	result.ExpiresAt = expiresAt(order.Timeout)
 
 	switch order.TradeMethod {
 	case K_TRADE_METHOD_WAP:
-		return this.tradeWapPay(order.OrderNo, subject, order.IP, amount, order.Timeout)
+		result.Kind = K_PAYMENT_KIND_REDIRECT
+		result.Payload, err = this.tradeWapPay(ctx, order.OrderNo, subject, order.IP, amount, order.Timeout)
 	case K_TRADE_METHOD_APP:
-		return this.tradeAppPay(order.OrderNo, subject, order.IP, amount, order.Timeout)
+		result.Kind = K_PAYMENT_KIND_APP_PARAMS
+		result.Params, err = this.tradeAppPay(ctx, order.OrderNo, subject, order.IP, amount, order.Timeout)
+		if err == nil {
+			result.Payload, err = marshalParams(result.Params)
+		}
 	case K_TRADE_METHOD_QRCODE:
-		return this.tradeQRCode(order.OrderNo, subject, order.IP, amount, order.Timeout)
-
+		result.Kind = K_PAYMENT_KIND_QRCODE
+		result.Payload, err = this.tradeQRCode(ctx, order.OrderNo, subject, order.IP, amount, order.Timeout)
+	case K_TRADE_METHOD_F2F:
+		result.Kind = K_PAYMENT_KIND_COMPLETED
+		result.ExpiresAt = time.Time{}
+		result.TradeNo, err = this.tradeFaceToFace(ctx, order.OrderNo, order.AuthCode, subject, order.IP, amount)
+	case K_TRADE_METHOD_JSAPI, K_TRADE_METHOD_MINI_PROGRAM:
+		result.Kind = K_PAYMENT_KIND_APP_PARAMS
+		result.Params, err = this.tradeJSAPI(ctx, order.OrderNo, subject, order.IP, order.OpenId, amount, order.Timeout)
+		if err == nil {
+			result.Payload, err = marshalParams(result.Params)
+		}
+	default:
+		return nil, &CapabilityError{Channel: this.Identifier(), Kind: K_CAPABILITY_TRADE_METHOD, Value: order.TradeMethod}
+	}
+	if err != nil {
+		return nil, err
 	}
-	return "", err
+	return result, nil
 }
 
-func (this *WXPay) trade(tradeType, orderNo, subject, ip string, amount, timeout int) (*wxpay.UnifiedOrderResp, error) {
+func (this *WXPay) trade(ctx context.Context, tradeType, orderNo, subject, ip, openId string, amount, timeout int) (*wxpay.UnifiedOrderResp, error) {
 	var p = wxpay.UnifiedOrderParam{}
 	p.Body = subject
 
@@ -77,6 +138,7 @@ func (this *WXPay) trade(tradeType, orderNo, subject, ip string, amount, timeout
 
 	p.TradeType = tradeType
 	p.SpbillCreateIP = ip
+	p.OpenId = openId
 
 	p.TotalFee = amount
 	p.OutTradeNo = orderNo
@@ -90,43 +152,202 @@ func (this *WXPay) trade(tradeType, orderNo, subject, ip string, amount, timeout
 		p.TimeExpire = expire.Format("20060102150405")
 	}
 
-	rsp, err := this.client.UnifiedOrder(p)
+	var rsp *wxpay.UnifiedOrderResp
+	err := invoke(ctx, func() (err error) {
+		rsp, err = this.client.UnifiedOrder(p)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
+
+	if rsp.ReturnCode != k_WXPAY_RESULT_CODE_SUCCESS {
+		return nil, errors.New(rsp.ReturnMsg)
+	}
+	if rsp.ResultCode != k_WXPAY_RESULT_CODE_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
 	return rsp, nil
 }
 
-func (this *WXPay) tradeWapPay(orderNo, subject, ip string, amount, timeout int) (url string, err error) {
-	rsp, err := this.trade(wxpay.K_TRADE_TYPE_MWEB, orderNo, subject, ip, amount, timeout)
+func (this *WXPay) tradeWapPay(ctx context.Context, orderNo, subject, ip string, amount, timeout int) (url string, err error) {
+	rsp, err := this.trade(ctx, wxpay.K_TRADE_TYPE_MWEB, orderNo, subject, ip, "", amount, timeout)
 	if err != nil {
 		return "", err
 	}
 	return rsp.MWebURL, nil
 }
 
-func (this *WXPay) tradeAppPay(orderNo, subject, ip string, amount, timeout int) (url string, err error) {
-	rsp, err := this.trade(wxpay.K_TRADE_TYPE_APP, orderNo, subject, ip, amount, timeout)
+// tradeAppPay 返回 App 调用微信支付 SDK 需要的参数，这些参数需要使用 prepay_id 再次进行签名
+func (this *WXPay) tradeAppPay(ctx context.Context, orderNo, subject, ip string, amount, timeout int) (params map[string]string, err error) {
+	rsp, err := this.trade(ctx, wxpay.K_TRADE_TYPE_APP, orderNo, subject, ip, "", amount, timeout)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return rsp.PrepayId, nil
+
+	params = make(map[string]string)
+	params["appid"] = this.appId
+	params["partnerid"] = this.mchId
+	params["prepayid"] = rsp.PrepayId
+	params["package"] = "Sign=WXPay"
+	params["noncestr"] = nonceStr()
+	params["timestamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+	params["sign"] = this.sign(params)
+	return params, nil
 }
 
-func (this *WXPay) tradeQRCode(orderNo, subject, ip string, amount, timeout int) (url string, err error) {
-	rsp, err := this.trade(wxpay.K_TRADE_TYPE_NATIVE, orderNo, subject, ip, amount, timeout)
+// tradeJSAPI 返回公众号（WeixinJSBridge、chooseWXPay）和小程序（wx.requestPayment）发起支付需要的参数。
+// 小程序支付时，需要使用小程序的 AppId 创建 WXPay。
+func (this *WXPay) tradeJSAPI(ctx context.Context, orderNo, subject, ip, openId string, amount, timeout int) (params map[string]string, err error) {
+	rsp, err := this.trade(ctx, wxpay.K_TRADE_TYPE_JSAPI, orderNo, subject, ip, openId, amount, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	params = make(map[string]string)
+	params["appId"] = this.appId
+	params["timeStamp"] = strconv.FormatInt(time.Now().Unix(), 10)
+	params["nonceStr"] = nonceStr()
+	params["package"] = "prepay_id=" + rsp.PrepayId
+	params["signType"] = "MD5"
+	params["paySign"] = this.sign(params)
+	return params, nil
+}
+
+func (this *WXPay) tradeQRCode(ctx context.Context, orderNo, subject, ip string, amount, timeout int) (url string, err error) {
+	rsp, err := this.trade(ctx, wxpay.K_TRADE_TYPE_NATIVE, orderNo, subject, ip, "", amount, timeout)
 	if err != nil {
 		return "", err
 	}
 	return rsp.CodeURL, nil
 }
 
-func (this *WXPay) getTrade(tradeNo, orderNo string) (result *Trade, err error) {
+const (
+	k_WXPAY_ERR_CODE_USERPAYING  = "USERPAYING"
+	k_WXPAY_ERR_CODE_SYSTEMERROR = "SYSTEMERROR"
+	k_WXPAY_ERR_CODE_BANKERROR   = "BANKERROR"
+
+	k_WXPAY_REVERSE_RETRY = 3
+
+	k_WXPAY_TIME_LAYOUT = "20060102150405"
+)
+
+// tradeFaceToFace 扫描用户的付款码进行收款，支付结果未知时会轮询订单状态，直到支付成功或者超时，
+// 支付失败或者超时会撤销该订单
+func (this *WXPay) tradeFaceToFace(ctx context.Context, orderNo, authCode, subject, ip string, amount int) (tradeNo string, err error) {
+	var p = wxpay.MicroPayParam{}
+	p.Body = subject
+	p.OutTradeNo = orderNo
+	p.TotalFee = amount
+	p.SpbillCreateIP = ip
+	p.AuthCode = authCode
+
+	var rsp *wxpay.MicroPayResp
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.MicroPay(p)
+		return err
+	})
+	if err == nil {
+		if rsp.ResultCode == k_WXPAY_RESULT_CODE_SUCCESS {
+			return rsp.TransactionId, nil
+		}
+
+		switch rsp.ErrCode {
+		case k_WXPAY_ERR_CODE_USERPAYING, k_WXPAY_ERR_CODE_SYSTEMERROR, k_WXPAY_ERR_CODE_BANKERROR:
+			// 需要等待用户输入密码或者支付结果未知，需要查询订单确认
+		default:
+			// 明确失败的交易不需要撤销，通信失败（return_code 为 FAIL）时没有 err_code_des
+			if rsp.ErrCodeDes == "" {
+				return "", errors.New(rsp.ReturnMsg)
+			}
+			return "", errors.New(rsp.ErrCodeDes)
+		}
+	}
+
+	if tradeNo, err = this.waitForPayment(ctx, orderNo); err != nil {
+		// ctx 被取消时也需要撤销订单，避免之后用户完成支付
+		if rErr := this.reverse(context.Background(), orderNo); rErr != nil {
+			var e = &TradeReverseError{}
+			e.Channel = K_CHANNEL_WXPAY
+			e.OrderNo = orderNo
+			e.Err = err
+			e.ReverseErr = rErr
+			return "", e
+		}
+		return "", err
+	}
+	return tradeNo, nil
+}
+
+// waitForPayment 轮询订单状态，直到支付成功、支付失败或者超时
+func (this *WXPay) waitForPayment(ctx context.Context, orderNo string) (tradeNo string, err error) {
+	var p = wxpay.OrderQueryParam{}
+	p.OutTradeNo = orderNo
+
+	var deadline = time.Now().Add(k_F2F_QUERY_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if err = sleep(ctx, k_F2F_QUERY_INTERVAL); err != nil {
+			return "", err
+		}
+
+		var rsp *wxpay.OrderQueryResp
+		err = call(ctx, func() (err error) {
+			rsp, err = this.client.OrderQuery(p)
+			return err
+		})
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if err != nil {
+			continue
+		}
+
+		switch rsp.TradeState {
+		case wxpay.K_TRADE_STATE_SUCCESS:
+			return rsp.TransactionId, nil
+		case wxpay.K_TRADE_STATE_USERPAYING, wxpay.K_TRADE_STATE_NOTPAY:
+			continue
+		default:
+			return "", errors.New(rsp.TradeStateDesc)
+		}
+	}
+	return "", ErrTradeTimeout
+}
+
+// reverse 撤销订单，微信支付返回需要重试时会进行重试
+func (this *WXPay) reverse(ctx context.Context, orderNo string) (err error) {
+	var p = wxpay.ReverseParam{}
+	p.OutTradeNo = orderNo
+
+	for i := 0; i < k_WXPAY_REVERSE_RETRY; i++ {
+		var rsp *wxpay.ReverseResp
+		err = invoke(ctx, func() (err error) {
+			rsp, err = this.client.Reverse(p)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if rsp.ResultCode == k_WXPAY_RESULT_CODE_SUCCESS {
+			return nil
+		}
+		if rsp.Recall != "Y" {
+			return errors.New(rsp.ErrCodeDes)
+		}
+	}
+	return ErrTradeReverseFailed
+}
+
+func (this *WXPay) getTrade(ctx context.Context, tradeNo, orderNo string) (result *Trade, err error) {
 	var p = wxpay.OrderQueryParam{}
 	p.TransactionId = tradeNo
 	p.OutTradeNo = orderNo
 
-	rsp, err := this.client.OrderQuery(p)
+	var rsp *wxpay.OrderQueryResp
+	err = call(ctx, func() (err error) {
+		rsp, err = this.client.OrderQuery(p)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -137,20 +358,386 @@ func (this *WXPay) getTrade(tradeNo, orderNo string) (result *Trade, err error)
 	result.OrderNo = rsp.OutTradeNo
 	result.TradeNo = rsp.TransactionId
 	result.TradeStatus = rsp.TradeState
-	result.TotalAmount = fmt.Sprintf("%.2f", float64(rsp.TotalFee)/100.0)
+	result.Status = tradeStatusWithWXPay(rsp.TradeState)
+	result.TotalAmount = NewMoney(int64(rsp.TotalFee), feeTypeWithWXPay(rsp.FeeType))
 	result.PayerId = rsp.OpenId
+	result.PaidAt = parseTime(k_WXPAY_TIME_LAYOUT, rsp.TimeEnd, k_CHINA_LOCATION)
 	if result.TradeStatus == wxpay.K_TRADE_STATE_SUCCESS {
 		result.TradeSuccess = true
 	}
+
+	// 微信支付的交易状态为 REFUND 时不区分全额退款和部分退款，需要根据退款金额判断
+	if result.TradeStatus == wxpay.K_TRADE_STATE_REFUND {
+		refunds, err := this.getRefunds(ctx, rsp.OutTradeNo, "")
+		if err != nil {
+			return nil, err
+		}
+		var refunded = NewMoney(0, result.TotalAmount.Currency)
+		for _, refund := range refunds {
+			if refund.RefundStatus == K_REFUND_STATUS_SUCCESS {
+				refunded = refunded.Add(refund.RefundAmount)
+			}
+		}
+		if refunded.Amount < result.TotalAmount.Amount {
+			result.Status = K_TRADE_STATUS_PARTIALLY_REFUNDED
+		}
+		result.RefundedAmount = refunded
+	}
+	result.settle()
 	return result, nil
 }
 
+func tradeStatusWithWXPay(state string) string {
+	switch state {
+	case wxpay.K_TRADE_STATE_SUCCESS:
+		return K_TRADE_STATUS_PAID
+	case wxpay.K_TRADE_STATE_REFUND:
+		return K_TRADE_STATUS_REFUNDED
+	case wxpay.K_TRADE_STATE_CLOSED, wxpay.K_TRADE_STATE_REVOKED:
+		return K_TRADE_STATUS_CLOSED
+	case wxpay.K_TRADE_STATE_PAYERROR:
+		return K_TRADE_STATUS_FAILED
+	}
+	return K_TRADE_STATUS_PENDING
+}
+
+// feeTypeWithWXPay 微信支付的货币类型，为空时表示人民币
+func feeTypeWithWXPay(feeType string) string {
+	if feeType == "" {
+		return K_CURRENCY_CNY
+	}
+	return feeType
+}
+
 func (this *WXPay) GetTrade(tradeNo string) (result *Trade, err error) {
-	return this.getTrade(tradeNo, "")
+	return this.GetTradeContext(context.Background(), tradeNo)
+}
+
+func (this *WXPay) GetTradeContext(ctx context.Context, tradeNo string) (result *Trade, err error) {
+	return this.getTrade(ctx, tradeNo, "")
 }
 
 func (this *WXPay) GetTradeWithOrderNo(orderNo string) (result *Trade, err error) {
-	return this.getTrade("", orderNo)
+	return this.GetTradeWithOrderNoContext(context.Background(), orderNo)
+}
+
+func (this *WXPay) GetTradeWithOrderNoContext(ctx context.Context, orderNo string) (result *Trade, err error) {
+	return this.getTrade(ctx, "", orderNo)
+}
+
+func (this *WXPay) Refund(req *RefundRequest) (result *Refund, err error) {
+	return this.RefundContext(context.Background(), req)
+}
+
+func (this *WXPay) RefundContext(ctx context.Context, req *RefundRequest) (result *Refund, err error) {
+	// 微信支付退款需要提供订单总金额
+	var qp = wxpay.OrderQueryParam{}
+	qp.TransactionId = req.TradeNo
+	qp.OutTradeNo = req.OrderNo
+
+	var order *wxpay.OrderQueryResp
+	err = call(ctx, func() (err error) {
+		order, err = this.client.OrderQuery(qp)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var p = wxpay.RefundParam{}
+	p.TransactionId = req.TradeNo
+	p.OutTradeNo = req.OrderNo
+	p.OutRefundNo = req.RefundNo
+	p.TotalFee = order.TotalFee
+	p.RefundFee = order.TotalFee
+	if req.Amount.Amount > 0 {
+		p.RefundFee = int(req.Amount.Amount)
+	}
+	p.RefundDesc = req.Reason
+
+	var notifyURL = ngx.MustURL(this.NotifyURL)
+	notifyURL.Add("channel", this.Identifier())
+	notifyURL.Add("order_no", req.OrderNo)
+	notifyURL.Add("notify_type", k_WXPAY_NOTIFY_TYPE_REFUND)
+	p.NotifyURL = notifyURL.String()
+
+	var rsp *wxpay.RefundResp
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.Refund(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.ResultCode != k_WXPAY_RESULT_CODE_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
+
+	result = &Refund{}
+	result.Channel = this.Identifier()
+	result.RawRefund = rsp
+	result.OrderNo = rsp.OutTradeNo
+	result.TradeNo = rsp.TransactionId
+	result.RefundNo = rsp.OutRefundNo
+	result.RefundId = rsp.RefundId
+	result.RefundAmount = NewMoney(int64(rsp.RefundFee), feeTypeWithWXPay(rsp.FeeType))
+	// 微信支付退款为异步处理，需要通过退款查询或者退款通知获取最终结果
+	result.RefundStatus = K_REFUND_STATUS_PROCESSING
+	return result, nil
+}
+
+func (this *WXPay) getRefunds(ctx context.Context, orderNo, refundNo string) (result []*Refund, err error) {
+	var p = wxpay.RefundQueryParam{}
+	p.OutTradeNo = orderNo
+	p.OutRefundNo = refundNo
+
+	var rsp *wxpay.RefundQueryResp
+	err = call(ctx, func() (err error) {
+		rsp, err = this.client.RefundQuery(p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if rsp.ResultCode != k_WXPAY_RESULT_CODE_SUCCESS {
+		return nil, errors.New(rsp.ErrCodeDes)
+	}
+
+	result = make([]*Refund, 0, len(rsp.RefundInfos))
+	for _, info := range rsp.RefundInfos {
+		var refund = &Refund{}
+		refund.Channel = this.Identifier()
+		refund.RawRefund = rsp
+		refund.OrderNo = rsp.OutTradeNo
+		refund.TradeNo = rsp.TransactionId
+		refund.RefundNo = info.OutRefundNo
+		refund.RefundId = info.RefundId
+		refund.RefundAmount = NewMoney(int64(info.RefundFee), feeTypeWithWXPay(rsp.FeeType))
+		refund.RefundStatus = refundStatusWithWXPay(info.RefundStatus)
+		result = append(result, refund)
+	}
+	return result, nil
+}
+
+func refundStatusWithWXPay(status string) string {
+	switch status {
+	case wxpay.K_REFUND_STATUS_SUCCESS:
+		return K_REFUND_STATUS_SUCCESS
+	case wxpay.K_REFUND_STATUS_REFUNDCLOSE, wxpay.K_REFUND_STATUS_CHANGE:
+		return K_REFUND_STATUS_FAILED
+	}
+	return K_REFUND_STATUS_PROCESSING
+}
+
+func (this *WXPay) GetRefund(orderNo, refundNo string) (result *Refund, err error) {
+	return this.GetRefundContext(context.Background(), orderNo, refundNo)
+}
+
+func (this *WXPay) GetRefundContext(ctx context.Context, orderNo, refundNo string) (result *Refund, err error) {
+	refunds, err := this.getRefunds(ctx, orderNo, refundNo)
+	if err != nil {
+		return nil, err
+	}
+	for _, refund := range refunds {
+		if refund.RefundNo == refundNo {
+			return refund, nil
+		}
+	}
+	return nil, ErrUnknownRefundNo
+}
+
+func (this *WXPay) GetRefundsForOrder(orderNo string) (result []*Refund, err error) {
+	return this.GetRefundsForOrderContext(context.Background(), orderNo)
+}
+
+func (this *WXPay) GetRefundsForOrderContext(ctx context.Context, orderNo string) (result []*Refund, err error) {
+	return this.getRefunds(ctx, orderNo, "")
+}
+
+func (this *WXPay) CloseTrade(orderNo string) (err error) {
+	return this.CloseTradeContext(context.Background(), orderNo)
+}
+
+func (this *WXPay) CloseTradeContext(ctx context.Context, orderNo string) (err error) {
+	var p = wxpay.CloseOrderParam{}
+	p.OutTradeNo = orderNo
+
+	var rsp *wxpay.CloseOrderResp
+	err = invoke(ctx, func() (err error) {
+		rsp, err = this.client.CloseOrder(p)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	if rsp.ResultCode != k_WXPAY_RESULT_CODE_SUCCESS {
+		return errors.New(rsp.ErrCodeDes)
+	}
+	return nil
+}
+
+const (
+	k_WXPAY_DOWNLOAD_BILL_URL         = "https://api.mch.weixin.qq.com/pay/downloadbill"
+	k_WXPAY_SANDBOX_DOWNLOAD_BILL_URL = "https://api.mch.weixin.qq.com/sandboxnew/pay/downloadbill"
+
+	k_WXPAY_BILL_TYPE_ALL      = "ALL"
+	k_WXPAY_BILL_DATE_LAYOUT   = "20060102"
+	k_WXPAY_BILL_TIME_LAYOUT   = "2006-01-02 15:04:05"
+	k_WXPAY_BILL_NO_BILL_EXIST = "No Bill Exist"
+
+	// 对账单中各个字段的位置
+	k_WXPAY_BILL_COLUMN_TIME          = 0
+	k_WXPAY_BILL_COLUMN_TRADE_NO      = 5
+	k_WXPAY_BILL_COLUMN_ORDER_NO      = 6
+	k_WXPAY_BILL_COLUMN_TRADE_STATE   = 9
+	k_WXPAY_BILL_COLUMN_CURRENCY      = 11
+	k_WXPAY_BILL_COLUMN_SETTLEMENT    = 12
+	k_WXPAY_BILL_COLUMN_OUT_REFUND_NO = 15
+	k_WXPAY_BILL_COLUMN_REFUND_AMOUNT = 16
+	k_WXPAY_BILL_COLUMN_FEE           = 22
+	k_WXPAY_BILL_COLUMN_AMOUNT        = 24
+)
+
+type wxpayDownloadBillRequest struct {
+	XMLName  xml.Name `xml:"xml"`
+	AppId    string   `xml:"appid"`
+	MchId    string   `xml:"mch_id"`
+	NonceStr string   `xml:"nonce_str"`
+	Sign     string   `xml:"sign"`
+	BillDate string   `xml:"bill_date"`
+	BillType string   `xml:"bill_type"`
+}
+
+type wxpayDownloadBillError struct {
+	XMLName    xml.Name `xml:"xml"`
+	ReturnCode string   `xml:"return_code"`
+	ReturnMsg  string   `xml:"return_msg"`
+}
+
+func (this *WXPay) DownloadBill(date time.Time) (result *Bill, err error) {
+	return this.DownloadBillContext(context.Background(), date)
+}
+
+// DownloadBillContext 下载全部订单（ALL）的对账单，SDK 没有提供该接口，需要自行签名并发送请求
+func (this *WXPay) DownloadBillContext(ctx context.Context, date time.Time) (result *Bill, err error) {
+	result = &Bill{}
+	result.Channel = this.Identifier()
+	result.Start, result.End = billDay(date, k_CHINA_LOCATION)
+
+	var params = map[string]string{
+		"appid":     this.appId,
+		"mch_id":    this.mchId,
+		"nonce_str": nonceStr(),
+		"bill_date": result.Start.Format(k_WXPAY_BILL_DATE_LAYOUT),
+		"bill_type": k_WXPAY_BILL_TYPE_ALL,
+	}
+	var p = &wxpayDownloadBillRequest{}
+	p.AppId = params["appid"]
+	p.MchId = params["mch_id"]
+	p.NonceStr = params["nonce_str"]
+	p.BillDate = params["bill_date"]
+	p.BillType = params["bill_type"]
+	p.Sign = this.sign(params)
+
+	body, err := xml.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var apiURL = k_WXPAY_SANDBOX_DOWNLOAD_BILL_URL
+	if this.isProduction {
+		apiURL = k_WXPAY_DOWNLOAD_BILL_URL
+	}
+	req, err := http.NewRequest(http.MethodPost, apiURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	rsp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// 下载失败时返回 XML 格式的错误信息，成功时返回文本格式的对账单
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("<xml>")) {
+		var billErr = &wxpayDownloadBillError{}
+		if err = xml.Unmarshal(data, billErr); err != nil {
+			return nil, err
+		}
+		if billErr.ReturnMsg == k_WXPAY_BILL_NO_BILL_EXIST {
+			return result, nil
+		}
+		return nil, errors.New(billErr.ReturnMsg)
+	}
+
+	if result.Records, err = this.parseBill(string(data)); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// parseBill 对账单的第一行为标题，之后为明细，最后两行为汇总信息，每个字段以 ` 开头
+func (this *WXPay) parseBill(data string) (result []*BillRecord, err error) {
+	var lines = strings.Split(data, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if i == 0 || line == "" {
+			continue
+		}
+
+		var row = strings.Split(line, ",")
+		// 汇总信息的字段数量较少
+		if len(row) <= k_WXPAY_BILL_COLUMN_FEE {
+			break
+		}
+		for j := range row {
+			row[j] = strings.TrimPrefix(strings.TrimSpace(row[j]), "`")
+		}
+
+		var state = row[k_WXPAY_BILL_COLUMN_TRADE_STATE]
+		if state != wxpay.K_TRADE_STATE_SUCCESS && state != wxpay.K_TRADE_STATE_REFUND {
+			continue
+		}
+
+		var currency = feeTypeWithWXPay(row[k_WXPAY_BILL_COLUMN_CURRENCY])
+		var record = &BillRecord{}
+		record.Channel = this.Identifier()
+		record.TradeNo = row[k_WXPAY_BILL_COLUMN_TRADE_NO]
+		record.OrderNo = row[k_WXPAY_BILL_COLUMN_ORDER_NO]
+		record.Time = parseTime(k_WXPAY_BILL_TIME_LAYOUT, row[k_WXPAY_BILL_COLUMN_TIME], k_CHINA_LOCATION)
+		record.RawRecord = line
+
+		if state == wxpay.K_TRADE_STATE_REFUND {
+			record.Type = K_BILL_TYPE_REFUND
+			record.RefundNo = row[k_WXPAY_BILL_COLUMN_OUT_REFUND_NO]
+			record.Amount, err = parseBillMoney(row[k_WXPAY_BILL_COLUMN_REFUND_AMOUNT], currency)
+		} else {
+			record.Type = K_BILL_TYPE_TRADE
+			// 旧版对账单没有订单金额字段，使用应结订单金额
+			var amount = row[k_WXPAY_BILL_COLUMN_SETTLEMENT]
+			if len(row) > k_WXPAY_BILL_COLUMN_AMOUNT {
+				amount = row[k_WXPAY_BILL_COLUMN_AMOUNT]
+			}
+			record.Amount, err = parseBillMoney(amount, currency)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record.Fee, err = parseBillMoney(row[k_WXPAY_BILL_COLUMN_FEE], currency); err != nil {
+			return nil, err
+		}
+		result = append(result, record)
+	}
+	return result, nil
 }
 
 func (this *WXPay) ReturnRequestHandler(req *http.Request) (result *Trade, err error) {
@@ -158,7 +745,7 @@ func (this *WXPay) ReturnRequestHandler(req *http.Request) (result *Trade, err e
 	if tradeNo == "" {
 		return nil, ErrUnknownTradeNo
 	}
-	trade, err := this.GetTrade(tradeNo)
+	trade, err := this.GetTradeContext(req.Context(), tradeNo)
 	if err != nil {
 		return nil, err
 	}
@@ -166,27 +753,218 @@ func (this *WXPay) ReturnRequestHandler(req *http.Request) (result *Trade, err e
 }
 
 func (this *WXPay) NotifyRequestHandler(req *http.Request) (result *Notification, err error) {
-	noti, err := this.client.GetTradeNotification(req)
+	data, err := ioutil.ReadAll(req.Body)
 	if err != nil {
 		return nil, err
 	}
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(data))
 
 	req.ParseForm()
 	var notifyType = req.FormValue("notify_type")
+	if notifyType == "" {
+		// 在商户平台发起的退款，通知地址为商户平台配置的地址，没有 notify_type 参数，只能通过 req_info 判断
+		if bytes.Contains(data, []byte("<req_info>")) {
+			notifyType = k_WXPAY_NOTIFY_TYPE_REFUND
+		} else {
+			notifyType = k_WXPAY_NOTIFY_TYPE_TRADE
+		}
+	}
 
-	result = &Notification{}
-	result.Channel = this.Identifier()
-	result.RawNotify = noti
-
-	// TODO 需要处理退款
 	switch notifyType {
 	case k_WXPAY_NOTIFY_TYPE_TRADE:
+		noti, err := this.client.GetTradeNotification(req)
+		if err != nil {
+			return nil, err
+		}
+
+		result = &Notification{}
+		result.Channel = this.Identifier()
+		result.RawNotify = noti
 		result.NotifyType = K_NOTIFY_TYPE_TRADE
+		// 微信支付的通知没有唯一标识，同一笔交易只会发送一次支付结果通知，使用交易号代替
+		result.NotifyId = noti.TransactionId
 		result.OrderNo = noti.OutTradeNo
 		result.TradeNo = noti.TransactionId
+		result.TradeStatus = noti.ResultCode
+		result.Status = K_TRADE_STATUS_FAILED
+		if noti.ResultCode == k_WXPAY_RESULT_CODE_SUCCESS {
+			result.Status = K_TRADE_STATUS_PAID
+		}
+		result.Amount = NewMoney(int64(noti.TotalFee), feeTypeWithWXPay(noti.FeeType))
+		result.PayerId = noti.OpenId
 	case k_WXPAY_NOTIFY_TYPE_REFUND:
+		noti, err := this.getRefundNotification(data)
+		if err != nil {
+			return nil, err
+		}
+
+		result = &Notification{}
+		result.Channel = this.Identifier()
+		result.RawNotify = noti
 		result.NotifyType = K_NOTIFY_TYPE_REFUND
+		result.NotifyId = noti.RefundId
+		result.OrderNo = noti.OutTradeNo
+		result.TradeNo = noti.TransactionId
+		result.RefundNo = noti.OutRefundNo
+		result.RefundId = noti.RefundId
+		result.RefundStatus = refundStatusWithWXPay(noti.RefundStatus)
+		result.RefundAmount = NewMoney(int64(noti.RefundFee), feeTypeWithWXPay(noti.FeeType))
+		result.Amount = NewMoney(int64(noti.TotalFee), feeTypeWithWXPay(noti.FeeType))
+	default:
+		return nil, ErrUnknownNotification
+	}
+
+	return result, nil
+}
+
+type wxpayNotifyResponse struct {
+	XMLName    xml.Name `xml:"xml"`
+	ReturnCode string   `xml:"return_code"`
+	ReturnMsg  string   `xml:"return_msg"`
+}
+
+// WriteNotifyResponse 微信支付需要返回 return_code 为 SUCCESS 的 XML，否则会重新发送通知
+func (this *WXPay) WriteNotifyResponse(w http.ResponseWriter, err error) {
+	var rsp = &wxpayNotifyResponse{}
+	rsp.ReturnCode = k_WXPAY_RESULT_CODE_SUCCESS
+	rsp.ReturnMsg = "OK"
+	if err != nil {
+		rsp.ReturnCode = "FAIL"
+		rsp.ReturnMsg = err.Error()
+	}
+
+	data, _ := xml.Marshal(rsp)
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Write(data)
+}
+
+// sign 使用 MD5 方式对参数进行签名
+func (this *WXPay) sign(params map[string]string) string {
+	var keys = make([]string, 0, len(params))
+	for key, value := range params {
+		if key == "sign" || value == "" {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		buf.WriteString(key)
+		buf.WriteString("=")
+		buf.WriteString(params[key])
+		buf.WriteString("&")
+	}
+	buf.WriteString("key=")
+	buf.WriteString(this.apiKey)
+
+	var sum = md5.Sum(buf.Bytes())
+	return strings.ToUpper(hex.EncodeToString(sum[:]))
+}
+
+func nonceStr() string {
+	var b = make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func marshalParams(params map[string]string) (string, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// WXPayRefundNotification 微信支付退款通知中 req_info 解密之后的内容
+type WXPayRefundNotification struct {
+	XMLName             xml.Name `xml:"root"`
+	TransactionId       string   `xml:"transaction_id"`
+	OutTradeNo          string   `xml:"out_trade_no"`
+	RefundId            string   `xml:"refund_id"`
+	OutRefundNo         string   `xml:"out_refund_no"`
+	TotalFee            int      `xml:"total_fee"`
+	SettlementTotalFee  int      `xml:"settlement_total_fee"`
+	RefundFee           int      `xml:"refund_fee"`
+	SettlementRefundFee int      `xml:"settlement_refund_fee"`
+	FeeType             string   `xml:"fee_type"` // 境外商户的货币类型，境内商户没有该字段
+	RefundStatus        string   `xml:"refund_status"`
+	SuccessTime         string   `xml:"success_time"`
+	RefundRecvAccout    string   `xml:"refund_recv_accout"`
+	RefundAccount       string   `xml:"refund_account"`
+	RefundRequestSource string   `xml:"refund_request_source"`
+}
+
+type wxpayRefundNotifyBody struct {
+	XMLName    xml.Name `xml:"xml"`
+	ReturnCode string   `xml:"return_code"`
+	ReturnMsg  string   `xml:"return_msg"`
+	AppId      string   `xml:"appid"`
+	MCHId      string   `xml:"mch_id"`
+	NonceStr   string   `xml:"nonce_str"`
+	ReqInfo    string   `xml:"req_info"`
+}
+
+// getRefundNotification 解析退款通知，退款通知没有签名，req_info 使用商户 API 密钥的 MD5 值作为 key 进行 AES-256-ECB 加密，
+// 能够正常解密即表示通知来自微信支付
+func (this *WXPay) getRefundNotification(data []byte) (result *WXPayRefundNotification, err error) {
+	var body = &wxpayRefundNotifyBody{}
+	if err = xml.Unmarshal(data, body); err != nil {
+		return nil, err
+	}
+
+	if body.ReturnCode != k_WXPAY_RESULT_CODE_SUCCESS {
+		return nil, errors.New(body.ReturnMsg)
+	}
+	if body.AppId != this.appId || body.MCHId != this.mchId {
+		return nil, ErrUnknownNotification
+	}
+
+	cipherText, err := base64.StdEncoding.DecodeString(body.ReqInfo)
+	if err != nil {
+		return nil, err
+	}
+
+	var key = md5.Sum([]byte(this.apiKey))
+	plainText, err := aesECBDecrypt(cipherText, []byte(hex.EncodeToString(key[:])))
+	if err != nil {
+		return nil, err
 	}
 
+	result = &WXPayRefundNotification{}
+	if err = xml.Unmarshal(plainText, result); err != nil {
+		return nil, err
+	}
 	return result, nil
 }
+
+func aesECBDecrypt(cipherText, key []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var blockSize = block.BlockSize()
+	if len(cipherText) == 0 || len(cipherText)%blockSize != 0 {
+		return nil, ErrUnknownNotification
+	}
+
+	var plainText = make([]byte, len(cipherText))
+	for i := 0; i < len(cipherText); i += blockSize {
+		block.Decrypt(plainText[i:i+blockSize], cipherText[i:i+blockSize])
+	}
+
+	// PKCS#7 unpadding，填充的每个字节都为填充的长度
+	var padding = int(plainText[len(plainText)-1])
+	if padding == 0 || padding > blockSize {
+		return nil, ErrUnknownNotification
+	}
+	for _, b := range plainText[len(plainText)-padding:] {
+		if int(b) != padding {
+			return nil, ErrUnknownNotification
+		}
+	}
+	return plainText[:len(plainText)-padding], nil
+}
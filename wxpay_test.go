@@ -0,0 +1,143 @@
+package pay4go
+
+import (
+	"bytes"
+	"crypto/aes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// aesECBEncrypt 使用 PKCS#7 填充，与微信支付加密退款通知的方式相同
+func aesECBEncrypt(plainText, key []byte) []byte {
+	var padding = aes.BlockSize - len(plainText)%aes.BlockSize
+	return aesECBEncryptBlocks(append(plainText, bytes.Repeat([]byte{byte(padding)}, padding)...), key)
+}
+
+// aesECBEncryptBlocks 不进行填充，plainText 的长度需要为块大小的整数倍
+func aesECBEncryptBlocks(plainText, key []byte) []byte {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		panic(err)
+	}
+
+	var blockSize = block.BlockSize()
+	var cipherText = make([]byte, len(plainText))
+	for i := 0; i < len(plainText); i += blockSize {
+		block.Encrypt(cipherText[i:i+blockSize], plainText[i:i+blockSize])
+	}
+	return cipherText
+}
+
+func TestAESECBDecrypt(t *testing.T) {
+	var key = []byte("0123456789abcdef0123456789abcdef")
+
+	var tests = []struct {
+		name       string
+		cipherText []byte
+		plainText  string
+		err        bool
+	}{
+		{"短文本", aesECBEncrypt([]byte("<root>refund</root>"), key), "<root>refund</root>", false},
+		{"整块文本", aesECBEncrypt([]byte("0123456789abcdef"), key), "0123456789abcdef", false},
+		{"空文本", aesECBEncrypt([]byte{}, key), "", false},
+		{"长度不是块大小的整数倍", []byte("short"), "", true},
+		{"没有密文", []byte{}, "", true},
+		{"填充不合法", aesECBEncryptBlocks(bytes.Repeat([]byte{0}, 16), key), "", true},
+		{"填充长度超过块大小", aesECBEncryptBlocks(bytes.Repeat([]byte{17}, 16), key), "", true},
+		{"填充内容不一致", aesECBEncryptBlocks(append(bytes.Repeat([]byte{'a'}, 13), 1, 3, 3), key), "", true},
+	}
+
+	for _, test := range tests {
+		plainText, err := aesECBDecrypt(test.cipherText, key)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: 期望解密失败", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: 错误为 %v", test.name, err)
+			continue
+		}
+		if string(plainText) != test.plainText {
+			t.Errorf("%s: 结果为 %q，期望 %q", test.name, plainText, test.plainText)
+		}
+	}
+}
+
+// wxpayBillRow 生成一行对账单明细，fields 为字段位置及其内容
+func wxpayBillRow(fields map[int]string) string {
+	var row = make([]string, k_WXPAY_BILL_COLUMN_AMOUNT+1)
+	for i := range row {
+		row[i] = "`" + fields[i]
+	}
+	return strings.Join(row, ",")
+}
+
+func TestWXPayParseBill(t *testing.T) {
+	var data = strings.Join([]string{
+		"交易时间,公众账号ID,商户号,特约商户号,设备号,微信订单号,商户订单号,用户标识,交易类型,交易状态,付款银行,货币种类,应结订单金额,代金券金额,微信退款单号,商户退款单号,退款金额,充值券退款金额,退款类型,退款状态,商品名称,商户数据包,手续费,费率,订单金额,申请退款金额,费率备注",
+		wxpayBillRow(map[int]string{
+			k_WXPAY_BILL_COLUMN_TIME:        "2018-01-02 10:11:12",
+			k_WXPAY_BILL_COLUMN_TRADE_NO:    "4200000001",
+			k_WXPAY_BILL_COLUMN_ORDER_NO:    "order1",
+			k_WXPAY_BILL_COLUMN_TRADE_STATE: "SUCCESS",
+			k_WXPAY_BILL_COLUMN_CURRENCY:    "CNY",
+			k_WXPAY_BILL_COLUMN_SETTLEMENT:  "12.34",
+			k_WXPAY_BILL_COLUMN_FEE:         "0.07000",
+			k_WXPAY_BILL_COLUMN_AMOUNT:      "12.34",
+		}),
+		wxpayBillRow(map[int]string{
+			k_WXPAY_BILL_COLUMN_TIME:          "2018-01-02 13:14:15",
+			k_WXPAY_BILL_COLUMN_TRADE_NO:      "4200000001",
+			k_WXPAY_BILL_COLUMN_ORDER_NO:      "order1",
+			k_WXPAY_BILL_COLUMN_TRADE_STATE:   "REFUND",
+			k_WXPAY_BILL_COLUMN_CURRENCY:      "CNY",
+			k_WXPAY_BILL_COLUMN_OUT_REFUND_NO: "refund1",
+			k_WXPAY_BILL_COLUMN_REFUND_AMOUNT: "2.00",
+			k_WXPAY_BILL_COLUMN_FEE:           "-0.01200",
+		}),
+		wxpayBillRow(map[int]string{
+			k_WXPAY_BILL_COLUMN_TRADE_NO:    "4200000002",
+			k_WXPAY_BILL_COLUMN_ORDER_NO:    "order2",
+			k_WXPAY_BILL_COLUMN_TRADE_STATE: "REVOKED",
+		}),
+		"总交易单数,应结订单总金额,退款总金额,充值券退款总金额,手续费总金额,订单总金额,申请退款总金额",
+		"`2,`10.34,`2.00,`0.00,`0.06000,`12.34,`2.00",
+		"",
+	}, "\r\n")
+
+	var p = &WXPay{}
+	records, err := p.parseBill(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		kind     string
+		orderNo  string
+		refundNo string
+		amount   int64
+		fee      int64
+		time     time.Time
+	}{
+		{K_BILL_TYPE_TRADE, "order1", "", 1234, 7, time.Date(2018, 1, 2, 10, 11, 12, 0, k_CHINA_LOCATION)},
+		{K_BILL_TYPE_REFUND, "order1", "refund1", 200, 1, time.Date(2018, 1, 2, 13, 14, 15, 0, k_CHINA_LOCATION)},
+	}
+	if len(records) != len(tests) {
+		t.Fatalf("解析到 %d 条记录，期望 %d 条", len(records), len(tests))
+	}
+	for i, test := range tests {
+		var r = records[i]
+		if r.Channel != K_CHANNEL_WXPAY || r.Type != test.kind || r.OrderNo != test.orderNo || r.TradeNo != "4200000001" || r.RefundNo != test.refundNo {
+			t.Errorf("%d: 记录为 %+v", i, r)
+		}
+		if r.Amount != NewMoney(test.amount, K_CURRENCY_CNY) || r.Fee != NewMoney(test.fee, K_CURRENCY_CNY) {
+			t.Errorf("%d: 金额为 %v，手续费为 %v，期望 %d 和 %d", i, r.Amount, r.Fee, test.amount, test.fee)
+		}
+		if !r.Time.Equal(test.time) {
+			t.Errorf("%d: 时间为 %v，期望 %v", i, r.Time, test.time)
+		}
+	}
+}